@@ -0,0 +1,128 @@
+package corvallisbus
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+/*
+/admin/routeNames (admin only -- route names used by imports)
+
+Default: returns all route name overrides
+Paramaters:
+
+	gtfs: Google Transit route_id to change (optional); Default: ""
+	connexionz: Connexionz route name for gtfs (must be a route of /routes) -- override is removed when empty; Default: ""
+
+Response:
+
+	overrides: array of override objects (after change)
+
+Changes are used by the next import.
+*/
+func RouteNames(c Context, w http.ResponseWriter, r *http.Request) {
+	store := c.Store()
+
+	if gtfs := r.FormValue("gtfs"); gtfs != "" {
+		var err error
+		if name := r.FormValue("connexionz"); name != "" {
+			if !knownRoute(c, store, name) {
+				http.Error(w, "Unknown Connexionz route: "+name, 400)
+				return
+			}
+			err = store.PutRouteNameOverride(&RouteNameOverride{GTFS: gtfs, Connexionz: name})
+		} else {
+			err = store.DeleteRouteNameOverride(gtfs)
+		}
+
+		if err != nil {
+			http.Error(w, "Route Name Error: "+err.Error(), 500)
+			return
+		}
+	}
+
+	overrides, err := store.RouteNameOverrides()
+	if err != nil {
+		http.Error(w, "Route Name Error: "+err.Error(), 500)
+		return
+	}
+
+	result := map[string]interface{}{
+		"overrides": overrides,
+	}
+
+	data, errJSON := json.Marshal(result)
+	if errJSON != nil {
+		http.Error(w, errJSON.Error(), 500)
+		return
+	}
+
+	// Output JSON
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprint(w, string(data))
+}
+
+// Determine if name is a Connexionz route of the current dataset
+func knownRoute(c Context, store Store, name string) bool {
+	routes, err := cachedRoutes(c, store)
+	if err != nil {
+		return false
+	}
+
+	for _, route := range routes {
+		if route.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+/admin/datasets (admin only -- imported versions of information)
+
+Default: returns all datasets (newest first)
+Paramaters:
+
+	activate: version of dataset to use for queries -- rollback to previous import (optional); Default: ""
+
+Response:
+
+	datasets: array of dataset objects (after change)
+*/
+func Datasets(c Context, w http.ResponseWriter, r *http.Request) {
+	store := c.Store()
+
+	if version := r.FormValue("activate"); version != "" {
+		err := store.Activate(version)
+		if err == errUnknownDataset {
+			http.Error(w, "Unknown dataset: "+version, 404)
+			return
+		} else if err != nil {
+			http.Error(w, "Dataset Error: "+err.Error(), 500)
+			return
+		}
+
+		c.Infof("Activated dataset %s", version)
+	}
+
+	datasets, err := store.Datasets()
+	if err != nil {
+		http.Error(w, "Dataset Error: "+err.Error(), 500)
+		return
+	}
+
+	result := map[string]interface{}{
+		"datasets": datasets,
+	}
+
+	data, errJSON := json.Marshal(result)
+	if errJSON != nil {
+		http.Error(w, errJSON.Error(), 500)
+		return
+	}
+
+	// Output JSON
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprint(w, string(data))
+}
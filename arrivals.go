@@ -1,26 +1,16 @@
 package corvallisbus
 
 import (
-	"appengine"
-	"appengine/datastore"
-	"appengine/memcache"
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
-
-	cts "github.com/cvanderschuere/go-connexionz"
 )
 
-var globalRouteNames map[int64]string
-
-func init() {
-	globalRouteNames = make(map[int64]string)
-}
-
 /*
   /arrivals (endpoint to access arrival information)
 
@@ -34,7 +24,32 @@ func init() {
 
 
 */
-func Arrivals(c appengine.Context, w http.ResponseWriter, r *http.Request) {
+func Arrivals(c Context, w http.ResponseWriter, r *http.Request) {
+	stops, filterTime, checkCTS, ok := parseArrivalsRequest(c, w, r)
+	if !ok {
+		return
+	}
+
+	// Load arrivals from store add/or CTS
+	output := make(map[string]([]map[string]string))
+	for s, stopArrivals := range findArrivalsForStops(c, stops, checkCTS, &filterTime) {
+		output[s] = prepareStopOutput(stopArrivals, &filterTime)
+	}
+
+	// Output JSON
+	data, errJSON := json.Marshal(output)
+	if errJSON != nil {
+		http.Error(w, errJSON.Error(), 500)
+		return
+	}
+
+	// Output JSON
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprint(w, string(data))
+}
+
+// Parameters shared by /arrivals and /v2/arrivals -- responds with error when invalid
+func parseArrivalsRequest(c Context, w http.ResponseWriter, r *http.Request) (stops []string, filterTime time.Time, checkCTS bool, ok bool) {
 	// Make sure this is a GET request
 	if r.Method != "GET" {
 		http.Error(w, "Method not allowed", 405)
@@ -42,7 +57,7 @@ func Arrivals(c appengine.Context, w http.ResponseWriter, r *http.Request) {
 	}
 
 	sepStops := strings.Split(r.FormValue("stops"), ",")
-	c.Debugf("Stops:", sepStops)
+	c.Debugf("Stops: %v", sepStops)
 	if len(sepStops) == 0 || sepStops[0] == "" {
 		http.Error(w, "Missing required paramater: stops", 400)
 		return
@@ -52,7 +67,6 @@ func Arrivals(c appengine.Context, w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Use date input if avaliable
-	var filterTime time.Time
 	loc, _ := time.LoadLocation("America/Los_Angeles")
 	currentTime := time.Now().In(loc) // Must account for time zone
 	paramDate := r.FormValue("date")
@@ -71,19 +85,31 @@ func Arrivals(c appengine.Context, w http.ResponseWriter, r *http.Request) {
 
 	// Determine if arrivals could be avaliable
 	diff := filterTime.Sub(currentTime)
-	checkCTS := diff >= 0 && diff < 30*time.Minute
+	checkCTS = diff >= 0 && diff < 30*time.Minute
+
+	return sepStops, filterTime, checkCTS, true
+}
 
-	// Load arrivals from datastore add/or CTS
+// Stops loaded at the same time by findArrivalsForStops -- same as the limit of /arrivals
+const maxConcurrentStops = 20
+
+// Arrivals of each stop (keyed by stop as given) -- stops are loaded concurrently
+func findArrivalsForStops(c Context, stops []string, checkCTS bool, filterTime *time.Time) map[string]*stopArrivals {
 	var wg sync.WaitGroup
 	locker := new(sync.Mutex)
-	output := make(map[string]([]map[string]string))
-	for _, stopID := range sepStops {
+	output := make(map[string]*stopArrivals)
+	running := make(chan bool, maxConcurrentStops)
+	for _, stopID := range stops {
 		wg.Add(1)
+		running <- true
 
 		go func(s string) {
-			defer wg.Done()
+			defer func() {
+				<-running
+				wg.Done()
+			}()
 			stopNum, _ := strconv.ParseInt(s, 10, 64)
-			stopArrivals := findArrivalsForStop(c, stopNum, checkCTS, &filterTime)
+			stopArrivals := findArrivalsForStop(c, stopNum, checkCTS, filterTime)
 
 			// Add to map -- mutex protected
 			locker.Lock()
@@ -95,19 +121,10 @@ func Arrivals(c appengine.Context, w http.ResponseWriter, r *http.Request) {
 	// Wait for all stops to finish
 	wg.Wait()
 
-	// Output JSON
-	data, errJSON := json.Marshal(output)
-	if errJSON != nil {
-		http.Error(w, errJSON.Error(), 500)
-		return
-	}
-
-	// Output JSON
-	w.Header().Set("Content-Type", "application/json")
-	fmt.Fprint(w, string(data))
+	return output
 }
 
-func findArrivalsForStop(c appengine.Context, stopNum int64, checkCTS bool, filterTime *time.Time) []map[string]string {
+func findArrivalsForStop(c Context, stopNum int64, checkCTS bool, filterTime *time.Time) *stopArrivals {
 
 	// Realtime
 	realtimeETAs := make(chan []*ETA, 1)
@@ -120,187 +137,103 @@ func findArrivalsForStop(c appengine.Context, stopNum int64, checkCTS bool, filt
 
 	// Schedule
 	scheduledArrivals := make(chan []*Arrival, 1)
-	getArrivalsFromDatastore(c, stopNum, filterTime, scheduledArrivals)
+	getArrivalsFromStore(c, stopNum, filterTime, scheduledArrivals)
 
 	// Sync point -- make sure all data is known
 	scheds := <-scheduledArrivals
 	etas := <-realtimeETAs
 
-	// We need to combine eta and sched -- typical case
-	if len(etas) > 0 && len(scheds) > 1 {
-		// expected should be between the two scheduled
-		if etas[0].expected >= scheds[1].Scheduled {
-			scheds = scheds[1:]
-		}
-	} else if len(etas) > 0 && len(scheds) == 1 {
-		// Match them up regardless of time
-	} else if len(scheds) > 0 {
-		// no eta -- include schedule after current time
-		scheds = scheds[1:]
-	}
+	// Match each eta to a scheduled arrival of the same route
+	return matchArrivals(scheds, etas, sinceServiceDayStart(*filterTime))
+}
 
-	// Check if we should add extra etas
-	if len(etas) > len(scheds) {
-		l := len(scheds) // Save here because vals is growing
-		for _, eta := range etas[l:] {
-			r := &Arrival{
-				routeName: eta.route,
-				Scheduled: eta.expected,
-			}
-			scheds = append(scheds, r)
-		}
+// Combine all arrivals in order of expected arrival
+func prepareStopOutput(arrivals *stopArrivals, filterTime *time.Time) []map[string]string {
+	entries := []*outputEntry{}
+	for _, m := range arrivals.matched {
+		entries = append(entries, &outputEntry{m.arrival.Route, m.arrival.Scheduled, m.eta.expected})
+	}
+	for _, eta := range arrivals.unmatchedETAs {
+		entries = append(entries, &outputEntry{eta.route, eta.expected, eta.expected}) // Only expected time is known
+	}
+	for _, arr := range arrivals.unmatchedSchedules {
+		entries = append(entries, &outputEntry{arr.Route, arr.Scheduled, arr.Scheduled})
 	}
 
-	// Create arrivals
-	arrivalOutput := make([](map[string]string), len(scheds))
-	for i, arr := range scheds {
-		var o map[string]string
-		if len(etas) > i {
-			o = prepareArrivalOutput(c, arr, etas[i], filterTime)
-		} else {
-			o = prepareArrivalOutput(c, arr, nil, filterTime)
-		}
-		arrivalOutput[i] = o // Concurrent write
+	sort.Stable(byOutputExpected(entries))
+
+	arrivalOutput := make([](map[string]string), len(entries))
+	for i, e := range entries {
+		arrivalOutput[i] = prepareArrivalOutput(e.route, e.scheduled, e.expected, filterTime)
 	}
 
 	return arrivalOutput
 }
 
-// Fetch realtime info from connexionz
-func getRealtimeArrivals(c appengine.Context, stopNum int64, filterTime *time.Time, etaChan chan []*ETA) {
-	client := cts.New(c, baseURL)
+type outputEntry struct {
+	route               string
+	scheduled, expected time.Duration
+}
+
+type byOutputExpected []*outputEntry
 
-	plat := &cts.Platform{Number: stopNum}
+func (a byOutputExpected) Len() int           { return len(a) }
+func (a byOutputExpected) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byOutputExpected) Less(i, j int) bool { return a[i].expected < a[j].expected }
 
+// Fetch realtime info from connexionz (or GTFS-Realtime feeds)
+func getRealtimeArrivals(c Context, stopNum int64, filterTime *time.Time, etaChan chan []*ETA) {
 	// Make CTS call
-	ctsRoutes, _ := client.ETA(plat)
+	predictions, _ := c.Realtime().ETA(stopNum)
 
-	hour, min, sec := filterTime.Clock()
-	durationSinceMidnight := time.Duration(hour)*time.Hour + time.Duration(min)*time.Minute + time.Duration(sec)*time.Second
+	// Same reference as scheduled arrivals
+	sinceStart := sinceServiceDayStart(*filterTime)
 
 	ctsEstimates := []*ETA{}
-	for _, ctsRoute := range ctsRoutes {
-		if len(ctsRoute.Destination) > 0 {
-			if ctsRoute.Destination[0].Trip != nil {
-				// This stop+route as valid ETA
-				estDur := time.Duration(ctsRoute.Destination[0].Trip.ETA) * time.Minute
-
-				// Create new eta
-				e := &ETA{
-					route:    ctsRoute.Number,
-					expected: durationSinceMidnight + estDur,
-				}
-				ctsEstimates = append(ctsEstimates, e)
-			}
+	for _, prediction := range predictions {
+		// This stop+route as valid ETA
+		estDur := time.Duration(prediction.Minutes) * time.Minute
+
+		// Create new eta
+		e := &ETA{
+			route:    prediction.Route,
+			expected: sinceStart + estDur,
 		}
+		ctsEstimates = append(ctsEstimates, e)
 	}
 
 	etaChan <- ctsEstimates
 	close(etaChan)
 }
 
-func getArrivalsFromDatastore(c appengine.Context, stopNum int64, filterTime *time.Time, arrivalChan chan []*Arrival) {
-	var dest []*Arrival
-	stopNumString := strconv.FormatInt(stopNum, 10)
-
-	// Calc duration since midnight
-	hour, min, sec := filterTime.Clock()
-	durationSinceMidnight := time.Duration(hour)*time.Hour + time.Duration(min)*time.Minute + time.Duration(sec)*time.Second
-
-	fin := make(chan bool, 1)
-
-	// Check memcache
-	cacheName := "arrivalCache:" + stopNumString + ":" + filterTime.Weekday().String()
-	if _, memError := memcache.Gob.Get(c, cacheName, &dest); memError == memcache.ErrCacheMiss {
-		// Repopulate memcache
-		// Query for arrival
-		parent := datastore.NewKey(c, "Stop", "", stopNum, nil)
-		q := datastore.NewQuery("Arrival").Ancestor(parent)
-		//q = q.Filter("Scheduled >=", durationSinceMidnight)
-		q = q.Filter(filterTime.Weekday().String()+" =", true)
-		q = q.Order("Scheduled")
-
-		_, getError := q.GetAll(c, &dest)
-		if getError != nil {
-			arrivalChan <- nil
-			return // Probably invalid stop num
-		}
-
-		// Add to memcache
-		item := &memcache.Item{
-			Key:    cacheName,
-			Object: dest,
-		}
-
-		go func() {
-			memcache.Gob.Set(c, item) // We do enough work below that this will finish
-			fin <- true
-		}()
-
-		fin <- false
-
-		// Filter based on filterTime
-		dest = filterArrivalsOnTime(durationSinceMidnight, dest)
+func getArrivalsFromStore(c Context, stopNum int64, filterTime *time.Time, arrivalChan chan []*Arrival) {
+	// Calc duration since start of service day
+	sinceStart := sinceServiceDayStart(*filterTime)
 
-	} else if memError == memcache.ErrServerError {
-		fin <- false
+	// Query for arrivals (with holidays/breaks and late-night trips from yesterday)
+	dest, err := arrivalsForDay(c, stopNum, filterTime)
+	if err != nil {
 		arrivalChan <- nil
 		close(arrivalChan)
-		return
-	} else {
-		fin <- false
-		// Filter based on filterTime
-		dest = filterArrivalsOnTime(durationSinceMidnight, dest)
-	}
-
-	wg := new(sync.WaitGroup)
-	for _, val := range dest {
-		wg.Add(1)
-		// Determine route information
-		go func(arr *Arrival) {
-			defer wg.Done()
-
-			// Get route -- try global first
-			if savedName, ok := globalRouteNames[arr.Route.IntID()]; !ok {
-				var route Route
-				datastore.Get(c, arr.Route, &route)
-				arr.routeName = route.Name
-				globalRouteNames[arr.Route.IntID()] = route.Name
-			} else {
-				arr.routeName = savedName
-			}
-		}(val)
+		return // Probably invalid stop num
 	}
 
-	wg.Wait()
+	// Filter based on filterTime -- late buses can still arrive
+	dest = filterArrivalsOnTime(sinceStart-etaMatchWindow, dest)
 
-	<-fin               // Wait for memcache set
 	arrivalChan <- dest // Send back arrivals
-
 	close(arrivalChan)
 }
 
-func prepareArrivalOutput(c appengine.Context, val *Arrival, eta *ETA, filterTime *time.Time) map[string]string {
-
-	// Use this arrival to determine information
-	scheduled := val.Scheduled
-	expected := scheduled
-
-	// Realtime update
-	if eta != nil {
-		// Add eta offset
-		expected = eta.expected
-	}
-
-	loc, _ := time.LoadLocation("America/Los_Angeles")
+func prepareArrivalOutput(route string, scheduled, expected time.Duration, filterTime *time.Time) map[string]string {
 
 	//Convert to times
-	midnight := time.Date(filterTime.Year(), filterTime.Month(), filterTime.Day(), 0, 0, 0, 0, loc)
-	scheduledTime := midnight.Add(scheduled)
-	expectedTime := midnight.Add(expected)
+	start := serviceDayStart(*filterTime)
+	scheduledTime := start.Add(scheduled)
+	expectedTime := start.Add(expected)
 
 	m := map[string]string{
-		"Route":     val.routeName,
+		"Route":     route,
 		"Scheduled": scheduledTime.Format(time.RFC822Z),
 		"Expected":  expectedTime.Format(time.RFC822Z),
 	}
@@ -0,0 +1,186 @@
+package corvallisbus
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+/*
+/v2/arrivals (endpoint to access arrival information -- typed version of /arrivals)
+
+Default: nothing returned
+Paramaters:
+
+	stops: comma delimited list of stop numbers (required & limited to 20); Default: ""
+	date: date in RFC822Z format; Default: "currentDate"
+
+Response:
+
+	stops: map stopNumber to array of arrivals (ordered by expected time)
+	  Times are ISO-8601 (RFC 3339). Scheduled is missing for realtime
+	  arrivals without a matching scheduled arrival.
+*/
+func ArrivalsV2(c Context, w http.ResponseWriter, r *http.Request) {
+	stops, filterTime, checkCTS, ok := parseArrivalsRequest(c, w, r)
+	if !ok {
+		return
+	}
+
+	// Route information (color, direction)
+	store := c.Store()
+	routes, err := cachedRoutes(c, store)
+	if err != nil {
+		http.Error(w, "Get Routes Error: "+err.Error(), 500)
+		return
+	}
+
+	routeMap := make(map[string]*Route)
+	for _, route := range routes {
+		routeMap[route.Name] = route
+	}
+
+	// Stop information (adherance point)
+	ids := make([]int64, len(stops))
+	for i, s := range stops {
+		ids[i], _ = strconv.ParseInt(s, 10, 64)
+	}
+
+	stopInfo, err := store.Stops(ids)
+	if err != nil {
+		http.Error(w, "Get Stops Error: "+err.Error(), 500)
+		return
+	}
+
+	adherancePoints := make(map[string]bool)
+	for i, s := range stops {
+		adherancePoints[s] = stopInfo[i] != nil && stopInfo[i].AdherancePoint
+	}
+
+	output := make(map[string][]*ArrivalV2)
+	for s, stopArrivals := range findArrivalsForStops(c, stops, checkCTS, &filterTime) {
+		stopNum, _ := strconv.ParseInt(s, 10, 64)
+		directions := stopDirections(store, routes, stopNum)
+		output[s] = prepareStopOutputV2(stopArrivals, routeMap, directions, adherancePoints[s], &filterTime)
+	}
+
+	result := map[string]interface{}{
+		"stops": output,
+	}
+
+	data, errJSON := json.Marshal(result)
+	if errJSON != nil {
+		http.Error(w, errJSON.Error(), 500)
+		return
+	}
+
+	// Output JSON
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprint(w, string(data))
+}
+
+// Single arrival of a bus at a stop in /v2/arrivals
+type ArrivalV2 struct {
+	Route      string
+	RouteColor string `json:",omitempty"` // Hexadecimal
+	Headsign   string `json:",omitempty"` // Destination shown on bus (scheduled arrivals only)
+	Direction  string `json:",omitempty"` // Of the route's patterns through the stop -- missing if they differ
+	TripID     string `json:",omitempty"` // See /trips (scheduled arrivals only)
+
+	Scheduled    *time.Time `json:",omitempty"` // Missing for realtime arrivals without a schedule
+	Expected     time.Time  // Realtime estimate -- equal to Scheduled otherwise
+	MinutesUntil int        // Minutes from date until Expected
+
+	IsRealtime     bool // Expected is based on realtime information
+	AdherancePoint bool // Bus waits at stop until scheduled departure time
+}
+
+// Combine all arrivals in order of expected arrival
+func prepareStopOutputV2(arrivals *stopArrivals, routeMap map[string]*Route, directions map[string]string, adherancePoint bool, filterTime *time.Time) []*ArrivalV2 {
+	start := serviceDayStart(*filterTime)
+
+	newArrival := func(route string, arr *Arrival, eta *ETA) *ArrivalV2 {
+		a := &ArrivalV2{
+			Route:          route,
+			Direction:      directions[route],
+			IsRealtime:     eta != nil,
+			AdherancePoint: adherancePoint,
+		}
+
+		if r, ok := routeMap[route]; ok {
+			a.RouteColor = r.Color
+		}
+
+		if arr != nil {
+			scheduled := start.Add(arr.Scheduled)
+			a.Scheduled = &scheduled
+			a.Expected = scheduled
+			a.Headsign = arr.Headsign
+			a.TripID = arr.TripID
+		}
+
+		if eta != nil {
+			a.Expected = start.Add(eta.expected)
+		}
+
+		a.MinutesUntil = int(a.Expected.Sub(*filterTime) / time.Minute)
+
+		return a
+	}
+
+	output := []*ArrivalV2{}
+	for _, m := range arrivals.matched {
+		output = append(output, newArrival(m.arrival.Route, m.arrival, m.eta))
+	}
+	for _, eta := range arrivals.unmatchedETAs {
+		output = append(output, newArrival(eta.route, nil, eta))
+	}
+	for _, arr := range arrivals.unmatchedSchedules {
+		output = append(output, newArrival(arr.Route, arr, nil))
+	}
+
+	sort.Stable(byExpectedV2(output))
+
+	return output
+}
+
+// Direction of each route at stop -- routes with patterns of different directions through the stop are left out
+func stopDirections(store Store, routes []*Route, stopNum int64) map[string]string {
+	directions := make(map[string]string)
+	for _, route := range routes {
+		patterns, err := cachedRoutePatterns(store, route.Name)
+		if err != nil {
+			continue
+		}
+
+		direction, ambiguous := "", false
+		for _, pattern := range patterns {
+			for _, id := range pattern.Stops {
+				if id != stopNum {
+					continue
+				}
+
+				if direction != "" && direction != pattern.Direction {
+					ambiguous = true
+				}
+				direction = pattern.Direction
+				break
+			}
+		}
+
+		if direction != "" && !ambiguous {
+			directions[route.Name] = direction
+		}
+	}
+
+	return directions
+}
+
+type byExpectedV2 []*ArrivalV2
+
+func (a byExpectedV2) Len() int           { return len(a) }
+func (a byExpectedV2) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byExpectedV2) Less(i, j int) bool { return a[i].Expected.Before(a[j].Expected) }
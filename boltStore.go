@@ -0,0 +1,522 @@
+//go:build !appengine
+// +build !appengine
+
+package corvallisbus
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// Store backed by an embedded BoltDB file -- used when running outside of App Engine
+//
+// Buckets:
+//
+//	datasets: version -> bucket of imported information
+//	  info: Dataset
+//	  routes: name -> Route
+//	  patterns: route name -> []*RoutePattern
+//	  stops: platform number -> Stop
+//	  arrivals: platform number -> bucket of Arrival (autoincrement key)
+//	  trips: trip_id -> Trip
+//	  exceptions: date (YYYYMMDD) + "_" + service_id -> CalendarException
+//	meta: "active" -> version used by queries
+//	routeNames: GTFS route_id -> RouteNameOverride (shared by all versions)
+//
+// Values are gob encoded so fields hidden from JSON are kept.
+type BoltStore struct {
+	db      *bolt.DB
+	version string // Dataset used -- active dataset when empty
+}
+
+var (
+	datasetsBucket   = []byte("datasets")
+	metaBucket       = []byte("meta")
+	routeNamesBucket = []byte("routeNames")
+
+	routesBucket     = []byte("routes")
+	patternsBucket   = []byte("patterns")
+	stopsBucket      = []byte("stops")
+	arrivalsBucket   = []byte("arrivals")
+	tripsBucket      = []byte("trips")
+	exceptionsBucket = []byte("exceptions")
+
+	activeKey   = []byte("active")
+	infoKey     = []byte("info")
+	topBuckets  = [][]byte{datasetsBucket, metaBucket, routeNamesBucket}
+	dataBuckets = [][]byte{routesBucket, patternsBucket, stopsBucket, arrivalsBucket, tripsBucket, exceptionsBucket}
+
+	errNoDataset = errors.New("no dataset imported")
+)
+
+// Opens (or creates) the database at path
+func NewBoltStore(path string) (*BoltStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range topBuckets {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &BoltStore{db: db}, nil
+}
+
+func (s *BoltStore) Close() error {
+	return s.db.Close()
+}
+
+func (s *BoltStore) Routes() ([]*Route, error) {
+	routes := []*Route{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := s.bucket(tx, routesBucket)
+		if b == nil {
+			return nil
+		}
+
+		// Keys are sorted -- same as ordering by name
+		return b.ForEach(func(k, v []byte) error {
+			route := new(Route)
+			if err := decodeValue(v, route); err != nil {
+				return err
+			}
+			routes = append(routes, route)
+			return nil
+		})
+	})
+
+	return routes, err
+}
+
+func (s *BoltStore) PutRoute(route *Route) error {
+	return s.put(routesBucket, []byte(route.Name), route)
+}
+
+func (s *BoltStore) RoutePatterns(route string) ([]*RoutePattern, error) {
+	patterns := []*RoutePattern{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := s.bucket(tx, patternsBucket)
+		if b == nil {
+			return nil
+		}
+
+		v := b.Get([]byte(route))
+		if v == nil {
+			return nil
+		}
+		return decodeValue(v, &patterns)
+	})
+
+	return patterns, err
+}
+
+func (s *BoltStore) PutRoutePatterns(route string, patterns []*RoutePattern) error {
+	return s.put(patternsBucket, []byte(route), patterns)
+}
+
+func (s *BoltStore) Stops(ids []int64) ([]*Stop, error) {
+	stops := make([]*Stop, len(ids))
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := s.bucket(tx, stopsBucket)
+		if b == nil {
+			return nil // All left nil
+		}
+
+		for i, id := range ids {
+			v := b.Get(idToKey(id))
+			if v == nil {
+				continue // Left nil
+			}
+
+			stop := new(Stop)
+			if err := decodeValue(v, stop); err != nil {
+				return err
+			}
+			stops[i] = stop
+		}
+		return nil
+	})
+
+	return stops, err
+}
+
+func (s *BoltStore) AllStops() ([]*Stop, error) {
+	stops := []*Stop{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := s.bucket(tx, stopsBucket)
+		if b == nil {
+			return nil
+		}
+
+		return b.ForEach(func(k, v []byte) error {
+			stop := new(Stop)
+			if err := decodeValue(v, stop); err != nil {
+				return err
+			}
+			stops = append(stops, stop)
+			return nil
+		})
+	})
+
+	return stops, err
+}
+
+func (s *BoltStore) PutStop(stop *Stop) error {
+	return s.put(stopsBucket, idToKey(stop.ID), stop)
+}
+
+func (s *BoltStore) Arrivals(stop int64, day time.Weekday) ([]*Arrival, error) {
+	return s.arrivals(stop, func(arr *Arrival) bool {
+		return arr.runsOn(day)
+	})
+}
+
+func (s *BoltStore) ServiceArrivals(stop int64, serviceID string) ([]*Arrival, error) {
+	return s.arrivals(stop, func(arr *Arrival) bool {
+		return arr.ServiceID == serviceID
+	})
+}
+
+// Arrivals at stop matching filter sorted by scheduled time
+func (s *BoltStore) arrivals(stop int64, filter func(*Arrival) bool) ([]*Arrival, error) {
+	arrivals := []*Arrival{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := s.bucket(tx, arrivalsBucket)
+		if b != nil {
+			b = b.Bucket(idToKey(stop))
+		}
+		if b == nil {
+			return nil // No arrivals at this stop
+		}
+
+		return b.ForEach(func(k, v []byte) error {
+			arr := new(Arrival)
+			if err := decodeValue(v, arr); err != nil {
+				return err
+			}
+			if filter(arr) {
+				arrivals = append(arrivals, arr)
+			}
+			return nil
+		})
+	})
+
+	sort.Sort(ByScheduled(arrivals))
+
+	return arrivals, err
+}
+
+func (s *BoltStore) PutArrivals(arrivals []*Arrival) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		arrivalsB := s.bucket(tx, arrivalsBucket)
+		if arrivalsB == nil {
+			return errNoDataset
+		}
+
+		for _, arr := range arrivals {
+			b, err := arrivalsB.CreateBucketIfNotExists(idToKey(arr.Stop))
+			if err != nil {
+				return err
+			}
+
+			seq, err := b.NextSequence()
+			if err != nil {
+				return err
+			}
+
+			v, err := encodeValue(arr)
+			if err != nil {
+				return err
+			}
+
+			if err := b.Put(idToKey(int64(seq)), v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *BoltStore) Trips(ids []string) ([]*Trip, error) {
+	trips := make([]*Trip, len(ids))
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := s.bucket(tx, tripsBucket)
+		if b == nil {
+			return nil // All left nil
+		}
+
+		for i, id := range ids {
+			v := b.Get([]byte(id))
+			if v == nil {
+				continue // Left nil
+			}
+
+			trip := new(Trip)
+			if err := decodeValue(v, trip); err != nil {
+				return err
+			}
+			trips[i] = trip
+		}
+		return nil
+	})
+
+	return trips, err
+}
+
+func (s *BoltStore) AllTrips() ([]*Trip, error) {
+	trips := []*Trip{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := s.bucket(tx, tripsBucket)
+		if b == nil {
+			return nil
+		}
+
+		return b.ForEach(func(k, v []byte) error {
+			trip := new(Trip)
+			if err := decodeValue(v, trip); err != nil {
+				return err
+			}
+			trips = append(trips, trip)
+			return nil
+		})
+	})
+
+	return trips, err
+}
+
+func (s *BoltStore) PutTrips(trips []*Trip) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := s.bucket(tx, tripsBucket)
+		if b == nil {
+			return errNoDataset
+		}
+
+		for _, trip := range trips {
+			v, err := encodeValue(trip)
+			if err != nil {
+				return err
+			}
+
+			if err := b.Put([]byte(trip.ID), v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *BoltStore) CalendarExceptions(date time.Time) ([]*CalendarException, error) {
+	exceptions := []*CalendarException{}
+	prefix := []byte(date.Format("20060102") + "_")
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := s.bucket(tx, exceptionsBucket)
+		if b == nil {
+			return nil
+		}
+
+		c := b.Cursor()
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			exception := new(CalendarException)
+			if err := decodeValue(v, exception); err != nil {
+				return err
+			}
+			exceptions = append(exceptions, exception)
+		}
+		return nil
+	})
+
+	return exceptions, err
+}
+
+func (s *BoltStore) PutCalendarException(exception *CalendarException) error {
+	k := []byte(exception.Date.Format("20060102") + "_" + exception.ServiceID)
+	return s.put(exceptionsBucket, k, exception)
+}
+
+func (s *BoltStore) RouteNameOverrides() ([]*RouteNameOverride, error) {
+	overrides := []*RouteNameOverride{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(routeNamesBucket).ForEach(func(k, v []byte) error {
+			override := new(RouteNameOverride)
+			if err := decodeValue(v, override); err != nil {
+				return err
+			}
+			overrides = append(overrides, override)
+			return nil
+		})
+	})
+
+	return overrides, err
+}
+
+func (s *BoltStore) PutRouteNameOverride(override *RouteNameOverride) error {
+	v, err := encodeValue(override)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(routeNamesBucket).Put([]byte(override.GTFS), v)
+	})
+}
+
+func (s *BoltStore) DeleteRouteNameOverride(gtfs string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(routeNamesBucket).Delete([]byte(gtfs))
+	})
+}
+
+func (s *BoltStore) Version() string {
+	var version string
+	s.db.View(func(tx *bolt.Tx) error {
+		version = s.versionIn(tx)
+		return nil
+	})
+
+	return version
+}
+
+func (s *BoltStore) Datasets() ([]*Dataset, error) {
+	datasets := []*Dataset{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		active := string(tx.Bucket(metaBucket).Get(activeKey))
+		return tx.Bucket(datasetsBucket).ForEach(func(k, v []byte) error {
+			dataset := new(Dataset)
+			if err := decodeValue(tx.Bucket(datasetsBucket).Bucket(k).Get(infoKey), dataset); err != nil {
+				return err
+			}
+			dataset.Active = dataset.Version == active
+			datasets = append(datasets, dataset)
+			return nil
+		})
+	})
+
+	// Newest first
+	for i, j := 0, len(datasets)-1; i < j; i, j = i+1, j-1 {
+		datasets[i], datasets[j] = datasets[j], datasets[i]
+	}
+
+	return datasets, err
+}
+
+func (s *BoltStore) NewDataset() (Store, error) {
+	dataset := newDataset()
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.Bucket(datasetsBucket).CreateBucket([]byte(dataset.Version))
+		if err != nil {
+			return err
+		}
+
+		for _, name := range dataBuckets {
+			if _, err := b.CreateBucket(name); err != nil {
+				return err
+			}
+		}
+
+		v, err := encodeValue(dataset)
+		if err != nil {
+			return err
+		}
+		return b.Put(infoKey, v)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &BoltStore{db: s.db, version: dataset.Version}, nil
+}
+
+func (s *BoltStore) Activate(version string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(datasetsBucket).Bucket([]byte(version)) == nil {
+			return errUnknownDataset
+		}
+
+		return tx.Bucket(metaBucket).Put(activeKey, []byte(version))
+	})
+}
+
+func (s *BoltStore) DeleteDataset(version string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if string(tx.Bucket(metaBucket).Get(activeKey)) == version {
+			return errActiveDataset
+		}
+
+		err := tx.Bucket(datasetsBucket).DeleteBucket([]byte(version))
+		if err == bolt.ErrBucketNotFound {
+			return errUnknownDataset
+		}
+		return err
+	})
+}
+
+//
+// Internal functions
+//
+
+// Version used by store during tx
+func (s *BoltStore) versionIn(tx *bolt.Tx) string {
+	if s.version != "" {
+		return s.version
+	}
+
+	return string(tx.Bucket(metaBucket).Get(activeKey))
+}
+
+// Bucket of dataset -- nil if nothing has been imported
+func (s *BoltStore) bucket(tx *bolt.Tx, name []byte) *bolt.Bucket {
+	dataset := tx.Bucket(datasetsBucket).Bucket([]byte(s.versionIn(tx)))
+	if dataset == nil {
+		return nil
+	}
+
+	return dataset.Bucket(name)
+}
+
+func (s *BoltStore) put(bucket, key []byte, value interface{}) error {
+	v, err := encodeValue(value)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := s.bucket(tx, bucket)
+		if b == nil {
+			return errNoDataset
+		}
+		return b.Put(key, v)
+	})
+}
+
+// Big endian so keys sort numerically
+func idToKey(id int64) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, uint64(id))
+	return k
+}
+
+func encodeValue(value interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(value)
+	return buf.Bytes(), err
+}
+
+func decodeValue(data []byte, value interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(value)
+}
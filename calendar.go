@@ -0,0 +1,179 @@
+package corvallisbus
+
+import (
+	"sort"
+	"time"
+)
+
+/*
+  Service calendar helpers
+
+  Arrivals are stored with the weekdays they run on (calendar.txt). Holidays
+  and breaks are listed separately as exceptions for an exact date
+  (calendar_dates.txt) that either add or remove a service for that day.
+
+  Times of a service day can be past midnight ("25:10:00") -- those trips run
+  early the next morning but belong to the previous day's service.
+
+  Times are offsets from "noon minus 12h" of the service day (GTFS). That is
+  midnight except when daylight saving time changes, where it is 11pm of
+  the previous day (spring) or 1am (fall) so wall-clock times stay correct.
+*/
+
+// US/Pacific -- fixed at UTC-8 when the time zone database can't be loaded
+func pacificLocation() *time.Location {
+	loc, err := time.LoadLocation("America/Los_Angeles")
+	if err != nil {
+		return time.FixedZone("PST", -8*60*60)
+	}
+	return loc
+}
+
+// Start of the service day on the date of t -- noon minus 12h in US/Pacific
+func serviceDayStart(t time.Time) time.Time {
+	loc := pacificLocation()
+	local := t.In(loc)
+	noon := time.Date(local.Year(), local.Month(), local.Day(), 12, 0, 0, 0, loc)
+
+	return noon.Add(-12 * time.Hour)
+}
+
+// Offset of t from the start of its service day -- comparable to Arrival.Scheduled
+func sinceServiceDayStart(t time.Time) time.Duration {
+	return t.Sub(serviceDayStart(t))
+}
+
+// Arrivals at stop relative to the service day of t (see serviceDayStart)
+//
+// Includes the tail of the previous service day (arrivals past midnight) so
+// late-night trips are found after midnight.
+func arrivalsForDay(c Context, stopNum int64, t *time.Time) ([]*Arrival, error) {
+	loc := pacificLocation()
+	local := t.In(loc)
+	midnight := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, loc)
+	previous := time.Date(local.Year(), local.Month(), local.Day()-1, 0, 0, 0, 0, loc)
+
+	arrivals, err := serviceDayArrivals(c, stopNum, midnight)
+	if err != nil {
+		return nil, err
+	}
+
+	tail, err := serviceDayArrivals(c, stopNum, previous)
+	if err != nil {
+		c.Errorf("Previous service day error: %v", err)
+		return arrivals, nil
+	}
+
+	// Length of previous day -- 23 or 25 hours when daylight saving time changes
+	previousStart := serviceDayStart(previous)
+	dayLength := serviceDayStart(midnight).Sub(previousStart)
+
+	for _, arr := range tail {
+		if !previousStart.Add(arr.Scheduled).Before(midnight) {
+			// Copy -- arrivals can be shared by cache
+			shifted := *arr
+			shifted.Scheduled -= dayLength
+			arrivals = append(arrivals, &shifted)
+		}
+	}
+
+	sort.Sort(ByScheduled(arrivals))
+
+	return arrivals, nil
+}
+
+// Arrivals at stop of the service day starting at midnight (weekday with exceptions)
+func serviceDayArrivals(c Context, stopNum int64, midnight time.Time) ([]*Arrival, error) {
+	arrivals, err := c.Store().Arrivals(stopNum, midnight.Weekday())
+	if err != nil {
+		return nil, err
+	}
+
+	return applyServiceExceptions(c, stopNum, &midnight, arrivals), nil
+}
+
+// Exceptions that apply on the date of t (US/Pacific)
+func serviceExceptions(c Context, t *time.Time) ([]*CalendarException, error) {
+	loc := pacificLocation()
+	local := t.In(loc)
+	midnight := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, loc)
+
+	return c.Store().CalendarExceptions(midnight)
+}
+
+// Removes arrivals of services not running on the date of t and adds those of
+// services running only on that date. Result is sorted by scheduled time.
+func applyServiceExceptions(c Context, stopNum int64, t *time.Time, arrivals []*Arrival) []*Arrival {
+	exceptions, err := serviceExceptions(c, t)
+	if err != nil {
+		c.Errorf("Calendar exception error: %v", err)
+		return arrivals
+	} else if len(exceptions) == 0 {
+		return arrivals
+	}
+
+	removed := make(map[string]bool)
+	var added []string
+	for _, exception := range exceptions {
+		switch exception.Type {
+		case ServiceAdded:
+			added = append(added, exception.ServiceID)
+		case ServiceRemoved:
+			removed[exception.ServiceID] = true
+		}
+	}
+
+	result := make([]*Arrival, 0, len(arrivals))
+	for _, arr := range arrivals {
+		if !removed[arr.ServiceID] {
+			result = append(result, arr)
+		}
+	}
+
+	for _, serviceID := range added {
+		extra, err := c.Store().ServiceArrivals(stopNum, serviceID)
+		if err != nil {
+			c.Errorf("Added service error (%s): %v", serviceID, err)
+			continue
+		}
+
+		for _, arr := range extra {
+			// Already included by weekday
+			if !arr.runsOn(t.Weekday()) {
+				result = append(result, arr)
+			}
+		}
+	}
+
+	sort.Sort(ByScheduled(result))
+
+	return result
+}
+
+// Determine if trip runs on the given day of the week (calendar.txt without exceptions)
+func (t *Trip) runsOn(day time.Weekday) bool {
+	i := (int(day) + 6) % 7 // Monday first
+	return i < len(t.Days) && t.Days[i]
+}
+
+// Determine if arrival runs on the given day of the week
+func (a *Arrival) runsOn(day time.Weekday) bool {
+	switch day {
+	case time.Monday:
+		return a.Monday
+	case time.Tuesday:
+		return a.Tuesday
+	case time.Wednesday:
+		return a.Wednesday
+	case time.Thursday:
+		return a.Thursday
+	case time.Friday:
+		return a.Friday
+	case time.Saturday:
+		return a.Saturday
+	case time.Sunday:
+		return a.Sunday
+	}
+
+	return false
+}
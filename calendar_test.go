@@ -0,0 +1,87 @@
+package corvallisbus
+
+import (
+	"testing"
+	"time"
+)
+
+// Sundays when daylight saving time starts & ends -- and a normal Sunday
+var dstDays = []struct {
+	name      string
+	date      time.Time // Midnight US/Pacific
+	dayLength time.Duration
+}{
+	{"spring", pacificDate(2026, time.March, 8), 23 * time.Hour},
+	{"fall", pacificDate(2026, time.November, 1), 25 * time.Hour},
+	{"normal", pacificDate(2026, time.March, 15), 24 * time.Hour},
+}
+
+func pacificDate(year int, month time.Month, day int) time.Time {
+	loc, _ := time.LoadLocation("America/Los_Angeles")
+	return time.Date(year, month, day, 0, 0, 0, 0, loc)
+}
+
+func TestServiceDayStartDST(t *testing.T) {
+	loc, _ := time.LoadLocation("America/Los_Angeles")
+
+	for _, day := range dstDays {
+		start := serviceDayStart(day.date.Add(12 * time.Hour))
+
+		// "08:00:00"
+		at := start.Add(8 * time.Hour).In(loc)
+		if at.Day() != day.date.Day() || at.Hour() != 8 || at.Minute() != 0 {
+			t.Errorf("%s: 08:00:00 is %v", day.name, at)
+		}
+
+		eight := time.Date(day.date.Year(), day.date.Month(), day.date.Day(), 8, 0, 0, 0, loc)
+		if since := sinceServiceDayStart(eight); since != 8*time.Hour {
+			t.Errorf("%s: 8am is %v after start of service day, want 8h", day.name, since)
+		}
+
+		// "25:30:00" -- early next morning
+		late := start.Add(25*time.Hour + 30*time.Minute).In(loc)
+		if late.Day() != day.date.Day()+1 || late.Hour() != 1 || late.Minute() != 30 {
+			t.Errorf("%s: 25:30:00 is %v", day.name, late)
+		}
+	}
+}
+
+func TestArrivalsForDayDST(t *testing.T) {
+	loc, _ := time.LoadLocation("America/Los_Angeles")
+
+	for _, day := range dstDays {
+		store := &testStore{arrivals: map[time.Weekday][]*Arrival{
+			time.Saturday: {{Route: "late", Scheduled: 25*time.Hour + 30*time.Minute}},
+			time.Sunday:   {{Route: "day", Scheduled: 8 * time.Hour}},
+		}}
+		c := &testContext{t: t, store: store}
+
+		now := day.date.Add(time.Hour)
+		arrivals, err := arrivalsForDay(c, 1, &now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(arrivals) != 2 {
+			t.Fatalf("%s: got %d arrivals, want 2", day.name, len(arrivals))
+		}
+
+		// Sorted -- Saturday's trip first
+		late, early := arrivals[0], arrivals[1]
+		if late.Route != "late" || early.Route != "day" {
+			t.Fatalf("%s: unexpected order %s, %s", day.name, late.Route, early.Route)
+		}
+
+		if want := 25*time.Hour + 30*time.Minute - day.dayLength; late.Scheduled != want {
+			t.Errorf("%s: late trip shifted to %v, want %v (shift of %v)", day.name, late.Scheduled, want, day.dayLength)
+		}
+
+		at := serviceDayStart(now).Add(late.Scheduled).In(loc)
+		if at.Day() != day.date.Day() || at.Hour() != 1 || at.Minute() != 30 {
+			t.Errorf("%s: late trip at %v, want 01:30", day.name, at)
+		}
+
+		if store.arrivals[time.Saturday][0].Scheduled != 25*time.Hour+30*time.Minute {
+			t.Errorf("%s: stored arrival was changed", day.name)
+		}
+	}
+}
@@ -0,0 +1,193 @@
+//go:build !appengine
+// +build !appengine
+
+// Standalone Corvallis Bus API server -- runs without App Engine
+//
+// Usage:
+//
+//	corvallis-bus [flags] serve           Serve /routes, /stops, /arrivals, ... (default)
+//	corvallis-bus [flags] import [feed]   Import Connexionz & Google Transit then exit
+//
+// import downloads the Google Transit Feed from -gtfs unless a local feed (zip
+// file or unpacked directory) is given.
+//
+// Information is kept in a BoltDB file inside -data.
+package main
+
+import (
+	"crypto/subtle"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	corvallisbus "github.com/OSU-App-Club/corvallis-bus-server"
+)
+
+var (
+	addr          = flag.String("http", ":8080", "listen address")
+	dataDir       = flag.String("data", ".", "directory for the database file")
+	connexionzURL = flag.String("connexionz", "http://www.corvallistransit.com/", "Connexionz base URL")
+	gtfsURL       = flag.String("gtfs", corvallisbus.GoogleTransitURL, "Google Transit Feed zip URL")
+	gtfsRTURLs    = flag.String("gtfs-rt", "", "comma delimited GTFS-Realtime feed URLs (TripUpdates, VehiclePositions) used instead of Connexionz ETAs")
+	etaPoll       = flag.Duration("eta-poll", 30*time.Second, "interval to poll ETAs of every stop in the background (0 fetches ETAs for each request)")
+	etaStaleness  = flag.Duration("eta-staleness", 2*time.Minute, "oldest polled ETAs used before falling back to the schedule")
+	adminToken    = flag.String("admin-token", "", "token required by /cron/ and /admin/ paths as \"Authorization: Bearer <token>\" (disabled when empty)")
+	debug         = flag.Bool("debug", false, "log debug messages")
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s [flags] [serve|import [feed]]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	corvallisbus.GoogleTransitURL = *gtfsURL
+	corvallisbus.SetRealtimeFeedURLs(*gtfsRTURLs)
+
+	store, err := corvallisbus.NewBoltStore(filepath.Join(*dataDir, "corvallisbus.db"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer store.Close()
+
+	c := corvallisbus.NewLocalContext(store, *connexionzURL, *debug)
+
+	switch flag.Arg(0) {
+	case "", "serve":
+		serve(c)
+	case "import":
+		var report *corvallisbus.ImportReport
+		if flag.NArg() > 1 {
+			report, err = corvallisbus.ImportFeedPath(c, flag.Arg(1))
+		} else {
+			report, err = corvallisbus.ImportData(c)
+		}
+
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		printReport(report)
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+}
+
+func serve(c corvallisbus.Context) {
+	http.Handle("/routes", handler(c, corvallisbus.Routes))
+	http.Handle("/stops", handler(c, corvallisbus.Stops))
+	http.Handle("/arrivals", handler(c, corvallisbus.Arrivals))
+	http.Handle("/v2/arrivals", handler(c, corvallisbus.ArrivalsV2))
+	http.Handle("/trips", handler(c, corvallisbus.Trips))
+	http.Handle("/nearby", handler(c, corvallisbus.Nearby))
+	http.Handle("/stops/search", handler(c, corvallisbus.SearchStops))
+	http.Handle("/stops/", handler(c, corvallisbus.StopSchedule))
+	http.Handle("/routes/", handler(c, corvallisbus.RouteTimetable))
+	http.Handle("/plan", handler(c, corvallisbus.Plan))
+	http.Handle("/gtfs-rt/trip-updates", handler(c, corvallisbus.TripUpdates))
+
+	if *etaPoll > 0 {
+		corvallisbus.StartETAPoller(c, *etaPoll, *etaStaleness)
+	}
+
+	if *adminToken != "" {
+		http.HandleFunc("/cron/init", func(w http.ResponseWriter, r *http.Request) {
+			runImport(w, r, func() error {
+				_, err := corvallisbus.ImportData(c)
+				return err
+			})
+		})
+
+		// Paramaters:
+		//   feed: path to zip file or unpacked directory (required)
+		http.HandleFunc("/cron/import", func(w http.ResponseWriter, r *http.Request) {
+			feedPath := r.FormValue("feed")
+			if feedPath == "" {
+				http.Error(w, "Missing required paramater: feed", 400)
+				return
+			}
+
+			runImport(w, r, func() error {
+				_, err := corvallisbus.ImportFeedPath(c, feedPath)
+				return err
+			})
+		})
+
+		http.HandleFunc("/admin/routeNames", func(w http.ResponseWriter, r *http.Request) {
+			if authorized(w, r) {
+				corvallisbus.RouteNames(c, w, r)
+			}
+		})
+
+		http.HandleFunc("/admin/datasets", func(w http.ResponseWriter, r *http.Request) {
+			if authorized(w, r) {
+				corvallisbus.Datasets(c, w, r)
+			}
+		})
+	}
+
+	c.Infof("Listening on %s", *addr)
+	log.Fatal(http.ListenAndServe(*addr, nil))
+}
+
+// Determine if request has the admin token -- responds with error otherwise
+//
+// Token is sent in the Authorization header so it isn't written to access logs.
+func authorized(w http.ResponseWriter, r *http.Request) bool {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(*adminToken)) != 1 {
+		http.Error(w, "Forbidden", 403)
+		return false
+	}
+
+	return true
+}
+
+// Runs import in the background (same as App Engine) after checking token
+func runImport(w http.ResponseWriter, r *http.Request, f func() error) {
+	if !authorized(w, r) {
+		return
+	}
+
+	go func() {
+		if err := f(); err != nil {
+			log.Printf("ERROR: Import Error: %v", err)
+		}
+	}()
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// Lists information that couldn't be imported
+func printReport(report *corvallisbus.ImportReport) {
+	fmt.Printf("Imported dataset %s\n", report.Version)
+
+	if len(report.UnmappedRoutes) != 0 {
+		fmt.Printf("%d routes without a Connexionz route (schedule skipped -- see /admin/routeNames):\n", len(report.UnmappedRoutes))
+		for _, route := range report.UnmappedRoutes {
+			fmt.Printf("  %s\t%q\t%q\n", route.ID, route.ShortName, route.LongName)
+		}
+	}
+
+	if len(report.UnmatchedStops) == 0 {
+		return
+	}
+
+	fmt.Printf("%d stops without a Connexionz platform (arrivals skipped):\n", len(report.UnmatchedStops))
+	for _, stop := range report.UnmatchedStops {
+		fmt.Printf("  %s\tcode=%q\t%q\t%f,%f\troutes=%v\n", stop.ID, stop.Code, stop.Name, stop.Lat, stop.Lng, stop.Routes)
+	}
+}
+
+func handler(c corvallisbus.Context, f func(corvallisbus.Context, http.ResponseWriter, *http.Request)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f(c, w, r)
+	})
+}
@@ -0,0 +1,43 @@
+package corvallisbus
+
+// Connexionz is the CTS realtime system
+//   - https://github.com/cvanderschuere/go-connexionz
+//
+// Only the information used by the importer and /arrivals is exposed so the
+// rest of the package does not depend on the App Engine only client.
+type Connexionz interface {
+	Patterns() ([]*Pattern, error)
+	Platforms() ([]*Platform, error)
+
+	// Predicted arrivals at a platform (by number)
+	ETA(platform int64) ([]*Prediction, error)
+}
+
+// Bus stop as known by Connexionz
+type Platform struct {
+	Tag    int64 // Used by Google Transit
+	Number int64 // Same value posted at bus signs
+
+	Name           string
+	Road           string
+	Bearing        float64
+	AdherancePoint bool
+
+	Lat  float64
+	Long float64
+}
+
+// Single path of a route to a destination
+type Pattern struct {
+	Route       string // Route number
+	Destination string
+	Direction   string
+	Polyline    string
+	Platforms   []*Platform // Organized by order travelled
+}
+
+// Realtime estimate for the next bus of a route
+type Prediction struct {
+	Route   string
+	Minutes int // Until arrival
+}
@@ -0,0 +1,186 @@
+//go:build !appengine
+// +build !appengine
+
+package corvallisbus
+
+import (
+	"encoding/xml"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Connexionz over plain net/http -- go-connexionz only works on App Engine
+//
+// Reads the same public XML files as go-connexionz:
+//
+//	Platform.rxml -- all platforms
+//	RoutePattern.rxml -- routes, destinations and patterns
+//	RoutePositionET.xml -- ETAs for a single platform
+type connexionzClient struct {
+	baseURL string
+	client  *http.Client
+}
+
+func newConnexionzClient(baseURL string, client *http.Client) *connexionzClient {
+	if !strings.HasSuffix(baseURL, "/") {
+		baseURL += "/"
+	}
+
+	return &connexionzClient{baseURL: baseURL, client: client}
+}
+
+// XML formats (only attributes used by this package)
+type xmlPlatform struct {
+	Tag            int64   `xml:"PlatformTag,attr"`
+	Number         int64   `xml:"PlatformNo,attr"`
+	Name           string  `xml:"Name,attr"`
+	Road           string  `xml:"RoadName,attr"`
+	Bearing        float64 `xml:"BearingToRoad,attr"`
+	AdherancePoint bool    `xml:"ScheduleAdheranceTimepoint,attr"`
+	Position       struct {
+		Lat  float64 `xml:"Lat,attr"`
+		Long float64 `xml:"Long,attr"`
+	} `xml:"Position"`
+}
+
+type xmlRoute struct {
+	Number       string `xml:"RouteNo,attr"`
+	Destinations []struct {
+		Name     string `xml:"Name,attr"`
+		Patterns []struct {
+			Direction string         `xml:"Direction,attr"`
+			Platforms []*xmlPlatform `xml:"Platform"`
+		} `xml:"Pattern"`
+		Trips []struct {
+			ETA int `xml:"ETA,attr"`
+		} `xml:"Trip"`
+	} `xml:"Destination"`
+}
+
+func (c *connexionzClient) Patterns() ([]*Pattern, error) {
+	var doc struct {
+		Routes []*xmlRoute `xml:"Project>Route"`
+	}
+	if err := c.get("RoutePattern.rxml", nil, &doc); err != nil {
+		return nil, err
+	}
+
+	// Platforms in patterns only list tag & name -- fill in from Platform.rxml
+	platforms, err := c.Platforms()
+	if err != nil {
+		return nil, err
+	}
+
+	tagToPlatform := make(map[int64]*Platform)
+	for _, plat := range platforms {
+		tagToPlatform[plat.Tag] = plat
+	}
+
+	patterns := []*Pattern{}
+	for _, route := range doc.Routes {
+		for _, dest := range route.Destinations {
+			for _, pattern := range dest.Patterns {
+				// Polyline isn't part of the public XML (Mif) -- left empty
+				p := &Pattern{
+					Route:       route.Number,
+					Destination: dest.Name,
+					Direction:   pattern.Direction,
+				}
+
+				for _, xmlPlat := range pattern.Platforms {
+					plat := convertXMLPlatform(xmlPlat)
+					if full, ok := tagToPlatform[xmlPlat.Tag]; ok {
+						plat.Number = full.Number
+						plat.Road = full.Road
+						plat.Bearing = full.Bearing
+						plat.Lat = full.Lat
+						plat.Long = full.Long
+					}
+					p.Platforms = append(p.Platforms, plat)
+				}
+
+				patterns = append(patterns, p)
+			}
+		}
+	}
+
+	return patterns, nil
+}
+
+func (c *connexionzClient) Platforms() ([]*Platform, error) {
+	var doc struct {
+		Platforms []*xmlPlatform `xml:"Platform"`
+	}
+	if err := c.get("Platform.rxml", nil, &doc); err != nil {
+		return nil, err
+	}
+
+	platforms := make([]*Platform, len(doc.Platforms))
+	for i, xmlPlat := range doc.Platforms {
+		platforms[i] = convertXMLPlatform(xmlPlat)
+	}
+
+	return platforms, nil
+}
+
+func (c *connexionzClient) ETA(platform int64) ([]*Prediction, error) {
+	var doc struct {
+		Routes []*xmlRoute `xml:"Platform>Route"`
+	}
+	params := url.Values{"PlatformNo": {strconv.FormatInt(platform, 10)}}
+	if err := c.get("RoutePositionET.xml", params, &doc); err != nil {
+		return nil, err
+	}
+
+	predictions := []*Prediction{}
+	for _, route := range doc.Routes {
+		if len(route.Destinations) > 0 && len(route.Destinations[0].Trips) > 0 {
+			p := &Prediction{
+				Route:   route.Number,
+				Minutes: route.Destinations[0].Trips[0].ETA,
+			}
+			predictions = append(predictions, p)
+		}
+	}
+
+	return predictions, nil
+}
+
+//
+// Internal functions
+//
+
+func (c *connexionzClient) get(name string, params url.Values, v interface{}) error {
+	if params == nil {
+		params = url.Values{}
+	}
+	params.Set("ContentType", "SQLXML")
+	params.Set("Name", name)
+
+	resp, err := c.client.Get(c.baseURL + "RTT/Public/Utility/File.aspx?" + params.Encode())
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return &UpstreamError{URL: resp.Request.URL.String(), Status: resp.Status}
+	}
+
+	return xml.NewDecoder(resp.Body).Decode(v)
+}
+
+func convertXMLPlatform(plat *xmlPlatform) *Platform {
+	return &Platform{
+		Tag:            plat.Tag,
+		Number:         plat.Number,
+		Name:           plat.Name,
+		Road:           plat.Road,
+		Bearing:        plat.Bearing,
+		AdherancePoint: plat.AdherancePoint,
+		Lat:            plat.Position.Lat,
+		Long:           plat.Position.Long,
+	}
+}
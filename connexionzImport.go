@@ -1,96 +1,136 @@
 package corvallisbus
 
-import (
-	"appengine"
-	"appengine/datastore"
-	cts "github.com/cvanderschuere/go-connexionz"
-)
-
-func addRoutes(client *cts.CTS, c appengine.Context) error {
+// Stores every pattern of each route -- the longest also describes the route itself
+//
+// Returns all patterns
+func addRoutes(c Context) ([]*Pattern, error) {
 
 	// Download all patterns
-	routes, error := client.Patterns()
+	patterns, error := c.Connexionz().Patterns()
 	if error != nil {
-		return error
+		return nil, error
 	}
 
-	// Add routes
-	for _, route := range routes {
-		//c.Debugf("Route: ", route)
-
-		var dest *cts.Destination
-		// Choose the longest destination
-		for _, testTest := range route.Destination {
-			if dest == nil {
-				dest = testTest
-			} else if len(dest.Patterns[0].Platforms) < len(testTest.Patterns[0].Platforms) {
-				// Determine if this one is longer
-				dest = testTest
-			}
-		}
-
-		// Route dependend on name and direction ( no proper naming convention yet)
-		r := &Route{
-			Name:      route.Number,
-			Direction: dest.Patterns[0].Direction,
-			Polyline:  dest.Patterns[0].Polyline,
+	// Choose the longest pattern of each route
+	longest := make(map[string]*Pattern)
+	routePatterns := make(map[string][]*RoutePattern)
+	names := []string{}
+	for _, pattern := range patterns {
+		routePatterns[pattern.Route] = append(routePatterns[pattern.Route], convertPattern(pattern))
+
+		dest, ok := longest[pattern.Route]
+		if !ok {
+			names = append(names, pattern.Route)
+			longest[pattern.Route] = pattern
+		} else if len(dest.Platforms) < len(pattern.Platforms) {
+			// Determine if this one is longer
+			longest[pattern.Route] = pattern
 		}
+	}
 
-		//Loop over stops
-		stops := make([]*datastore.Key, len(dest.Patterns[0].Platforms))
-		for i, plat := range dest.Patterns[0].Platforms {
-			//c.Debugf("Plat: ", plat)
+	store := c.Store()
 
-			//Create stop key
-			k := datastore.NewKey(c, "Stop", "", plat.Number, nil)
+	// Stops of every pattern -- short-turns & other directions can stop where the longest doesn't
+	added := make(map[int64]bool)
+	for _, pattern := range patterns {
+		for _, plat := range pattern.Platforms {
+			if added[plat.Number] {
+				continue
+			}
+			added[plat.Number] = true
 
 			stop := &Stop{
+				ID:             plat.Number,
 				Name:           plat.Name,
-				AdherancePoint: plat.ScheduleAdheranceTimepoint,
+				AdherancePoint: plat.AdherancePoint,
+			}
+
+			//Insert into store
+			if err := store.PutStop(stop); err != nil {
+				c.Errorf("Stop Put Error (%d): %v", plat.Number, err)
 			}
+		}
+	}
 
-			//Insert into datastore
-			datastore.Put(c, k, stop)
+	// Add routes
+	for _, name := range names {
+		dest := longest[name]
 
-			stops[i] = k
+		// Route dependend on name and direction ( no proper naming convention yet)
+		r := &Route{
+			Name:      name,
+			Direction: dest.Direction,
+			Polyline:  dest.Polyline,
 		}
 
-		//Store stop keys
+		//Loop over stops
+		stops := make([]int64, len(dest.Platforms))
+		for i, plat := range dest.Platforms {
+			stops[i] = plat.Number
+		}
+
+		//Store stop ids
 		r.Stops = stops
 
-		//Add route datastore
-		rk := datastore.NewIncompleteKey(c, "Route", nil)
-		_, errRoute := datastore.Put(c, rk, r)
+		//Add route to store
+		errRoute := store.PutRoute(r)
 		if errRoute != nil {
-			c.Errorf("Route Put Error: ", errRoute)
+			c.Errorf("Route Put Error: %v", errRoute)
+		}
+
+		if err := store.PutRoutePatterns(name, routePatterns[name]); err != nil {
+			c.Errorf("Route Pattern Put Error (%s): %v", name, err)
 		}
 	}
 
-	return nil
+	return patterns, nil
+}
+
+func convertPattern(pattern *Pattern) *RoutePattern {
+	stops := make([]int64, len(pattern.Platforms))
+	for i, plat := range pattern.Platforms {
+		stops[i] = plat.Number
+	}
+
+	return &RoutePattern{
+		Destination: pattern.Destination,
+		Direction:   pattern.Direction,
+		Stops:       stops,
+		Polyline:    pattern.Polyline,
+	}
 }
 
 // Add individual information from each platform to existing skeleton
-func updatePlatforms(platforms []*cts.Platform, c appengine.Context) error {
-	for _, plat := range platforms {
+func updatePlatforms(c Context, platforms []*Platform) error {
+	store := c.Store()
+
+	ids := make([]int64, len(platforms))
+	for i, plat := range platforms {
+		ids[i] = plat.Number
+	}
+
+	stops, err := store.Stops(ids)
+	if err != nil {
+		return err
+	}
 
-		s := &Stop{}
-		k := datastore.NewKey(c, "Stop", "", plat.Number, nil)
+	for i, plat := range platforms {
 
-		err := datastore.Get(c, k, s)
-		if err != nil {
-			c.Debugf("Plat(2) Error Get: ", err, plat.Number, plat)
+		s := stops[i]
+		if s == nil {
+			c.Debugf("Plat(2) Error Get: %d %v", plat.Number, plat)
 			continue
 		}
 
 		//Update with new information
 		s.Bearing = plat.Bearing
-		s.Road = plat.RoadName
-		s.Lat = plat.Location.Latitude
-		s.Long = plat.Location.Longitude
+		s.Road = plat.Road
+		s.Lat = plat.Lat
+		s.Long = plat.Long
 
-		_, err = datastore.Put(c, k, s)
+		err = store.PutStop(s)
 		if err != nil {
-			c.Debugf("Plat(2) Error Put: ", err)
+			c.Debugf("Plat(2) Error Put: %v", err)
 			continue
 		}
 	}
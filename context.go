@@ -0,0 +1,33 @@
+package corvallisbus
+
+import (
+	"net/http"
+)
+
+// Context is the environment every request and import runs in.
+//
+// On App Engine it wraps appengine.Context (see main.go) and is backed by the
+// datastore. Outside of App Engine it is backed by a local store so the API
+// can run on any machine.
+type Context interface {
+	// Logging -- same signatures as appengine.Context
+	Debugf(format string, args ...interface{})
+	Infof(format string, args ...interface{})
+	Warningf(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+
+	Store() Store               // Routes, stops, arrivals and calendars
+	Connexionz() Connexionz     // CTS realtime information
+	Realtime() RealtimeProvider // Predicted arrivals -- Connexionz or GTFS-Realtime
+	HTTPClient() *http.Client   // Used to download feeds
+}
+
+// Upstream service (Connexionz, Google Transit) returned an unexpected response
+type UpstreamError struct {
+	URL    string
+	Status string
+}
+
+func (e *UpstreamError) Error() string {
+	return "Upstream Error: " + e.URL + " (" + e.Status + ")"
+}
@@ -0,0 +1,62 @@
+package corvallisbus
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+// In-memory Store for tests -- methods not overridden panic (nil Store)
+type testStore struct {
+	Store
+
+	version  string
+	arrivals map[time.Weekday][]*Arrival // Same for every stop
+	stops    []*Stop
+	trips    map[string]*Trip
+}
+
+func (s *testStore) Version() string {
+	return s.version
+}
+
+func (s *testStore) Arrivals(stop int64, day time.Weekday) ([]*Arrival, error) {
+	return s.arrivals[day], nil
+}
+
+func (s *testStore) CalendarExceptions(date time.Time) ([]*CalendarException, error) {
+	return nil, nil
+}
+
+func (s *testStore) AllStops() ([]*Stop, error) {
+	return s.stops, nil
+}
+
+func (s *testStore) Routes() ([]*Route, error) {
+	return []*Route{}, nil
+}
+
+func (s *testStore) Trips(ids []string) ([]*Trip, error) {
+	trips := make([]*Trip, len(ids))
+	for i, id := range ids {
+		trips[i] = s.trips[id]
+	}
+	return trips, nil
+}
+
+// Context for tests -- logs to t
+type testContext struct {
+	t        *testing.T
+	store    *testStore
+	realtime RealtimeProvider
+}
+
+func (c *testContext) Debugf(format string, args ...interface{})   { c.t.Logf(format, args...) }
+func (c *testContext) Infof(format string, args ...interface{})    { c.t.Logf(format, args...) }
+func (c *testContext) Warningf(format string, args ...interface{}) { c.t.Logf(format, args...) }
+func (c *testContext) Errorf(format string, args ...interface{})   { c.t.Logf(format, args...) }
+
+func (c *testContext) Store() Store               { return c.store }
+func (c *testContext) Connexionz() Connexionz     { return nil }
+func (c *testContext) Realtime() RealtimeProvider { return c.realtime }
+func (c *testContext) HTTPClient() *http.Client   { return http.DefaultClient }
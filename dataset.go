@@ -0,0 +1,66 @@
+package corvallisbus
+
+import (
+	"errors"
+	"time"
+)
+
+/*
+  Imported information is kept in versions (Dataset)
+
+  Imports write a new dataset that isn't visible to queries until it is
+  activated -- queries see the previous dataset in the meantime. The previous
+  dataset is kept for rollback (/admin/datasets), older ones are deleted.
+*/
+
+var (
+	errUnknownDataset = errors.New("unknown dataset")
+	errActiveDataset  = errors.New("dataset is active")
+)
+
+// Format of Dataset.Version
+const datasetVersionFormat = "20060102T150405.000Z"
+
+func newDataset() *Dataset {
+	now := time.Now().UTC()
+	return &Dataset{
+		Version: now.Format(datasetVersionFormat),
+		Created: now,
+	}
+}
+
+// Context writing to a dataset before it is activated
+type datasetContext struct {
+	Context
+	store Store
+}
+
+func (c datasetContext) Store() Store {
+	return c.store
+}
+
+// Deletes all datasets except keep
+func pruneDatasets(c Context, keep ...string) {
+	store := c.Store()
+
+	datasets, err := store.Datasets()
+	if err != nil {
+		c.Errorf("Dataset List Error: %v", err)
+		return
+	}
+
+	for _, dataset := range datasets {
+		kept := dataset.Active
+		for _, version := range keep {
+			kept = kept || dataset.Version == version
+		}
+
+		if kept {
+			continue
+		}
+
+		if err := store.DeleteDataset(dataset.Version); err != nil {
+			c.Errorf("Dataset Delete Error (%s): %v", dataset.Version, err)
+		}
+	}
+}
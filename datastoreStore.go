@@ -0,0 +1,489 @@
+//go:build appengine
+// +build appengine
+
+package corvallisbus
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"appengine/memcache"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Store backed by App Engine datastore -- reads are cached in memcache
+//
+// Each dataset is kept in its own namespace ("dataset-" + version) so
+// datastore and memcache keys don't change between versions. Datasets, the
+// active version and route name overrides are in the default namespace.
+type datastoreStore struct {
+	c       appengine.Context // Namespace of dataset
+	root    appengine.Context // Default namespace
+	version string
+}
+
+// Pointer to active dataset -- key "active"
+type activeDataset struct {
+	Version string
+}
+
+const activeDatasetCache = "activeDataset"
+
+// Store using the active dataset
+//
+// Information imported before datasets existed (no active version) is in the
+// default namespace and is used until the first import.
+func newDatastoreStore(c appengine.Context) (datastoreStore, error) {
+	var active activeDataset
+	if _, memError := memcache.Gob.Get(c, activeDatasetCache, &active); memError == memcache.ErrCacheMiss {
+		k := datastore.NewKey(c, "ActiveDataset", "active", 0, nil)
+		if err := datastore.Get(c, k, &active); err != nil && err != datastore.ErrNoSuchEntity {
+			return datastoreStore{c: c, root: c}, err
+		}
+
+		item := &memcache.Item{
+			Key:    activeDatasetCache,
+			Object: active,
+		}
+		memcache.Gob.Set(c, item)
+
+	} else if memError != nil {
+		return datastoreStore{c: c, root: c}, memError
+	}
+
+	return datastoreStore{c: c, root: c}.dataset(active.Version)
+}
+
+// Store using dataset version
+func (s datastoreStore) dataset(version string) (datastoreStore, error) {
+	if version == "" {
+		return datastoreStore{c: s.root, root: s.root}, nil
+	}
+
+	ns, err := appengine.Namespace(s.root, "dataset-"+version)
+	if err != nil {
+		return datastoreStore{c: s.root, root: s.root}, err
+	}
+
+	return datastoreStore{c: ns, root: s.root, version: version}, nil
+}
+
+func (s datastoreStore) Version() string {
+	return s.version
+}
+
+// Maximum entities per datastore batch call
+const datastoreBatchSize = 500
+
+func (s datastoreStore) Routes() ([]*Route, error) {
+	var routes []*Route
+
+	cacheName := "allRoutes"
+	if _, memError := memcache.Gob.Get(s.c, cacheName, &routes); memError == memcache.ErrCacheMiss {
+		// Load from datastore
+		_, err := datastore.NewQuery("Route").Order("Name").GetAll(s.c, &routes)
+		if err != nil {
+			return nil, err
+		}
+
+		// Save in memcache
+		item := &memcache.Item{
+			Key:    cacheName,
+			Object: routes,
+		}
+
+		go memcache.Gob.Set(s.c, item)
+	} else if memError != nil {
+		return nil, memError
+	}
+
+	return routes, nil
+}
+
+func (s datastoreStore) PutRoute(route *Route) error {
+	k := datastore.NewKey(s.c, "Route", route.Name, 0, nil)
+	_, err := datastore.Put(s.c, k, route)
+	return err
+}
+
+func (s datastoreStore) RoutePatterns(route string) ([]*RoutePattern, error) {
+	var patterns []*RoutePattern
+
+	cacheName := "routePatterns:" + route
+	if _, memError := memcache.Gob.Get(s.c, cacheName, &patterns); memError == memcache.ErrCacheMiss {
+		parent := datastore.NewKey(s.c, "Route", route, 0, nil)
+		_, err := datastore.NewQuery("RoutePattern").Ancestor(parent).Order("__key__").GetAll(s.c, &patterns)
+		if err != nil {
+			return nil, err
+		}
+
+		// Save in memcache
+		item := &memcache.Item{
+			Key:    cacheName,
+			Object: patterns,
+		}
+		memcache.Gob.Set(s.c, item)
+
+	} else if memError != nil {
+		return nil, memError
+	}
+
+	return patterns, nil
+}
+
+func (s datastoreStore) PutRoutePatterns(route string, patterns []*RoutePattern) error {
+	parent := datastore.NewKey(s.c, "Route", route, 0, nil)
+
+	// Keyed by position -- order is kept
+	keys := make([]*datastore.Key, len(patterns))
+	for i := range patterns {
+		keys[i] = datastore.NewKey(s.c, "RoutePattern", "", int64(i+1), parent)
+	}
+
+	_, err := datastore.PutMulti(s.c, keys, patterns)
+	return err
+}
+
+func (s datastoreStore) Stops(ids []int64) ([]*Stop, error) {
+	// Get these stops
+	stops := make([]*Stop, len(ids))
+
+	var wg sync.WaitGroup
+
+	for i, id := range ids {
+		wg.Add(1)
+
+		go func(idx int, id int64) {
+			defer wg.Done()
+
+			// Determine Cache Name
+			cacheName := "Stop:" + strconv.FormatInt(id, 10)
+
+			// Check memcache
+			stop := new(Stop)
+			if _, memError := memcache.Gob.Get(s.c, cacheName, stop); memError == memcache.ErrCacheMiss {
+				k := datastore.NewKey(s.c, "Stop", "", id, nil)
+				err := datastore.Get(s.c, k, stop)
+				if err != nil {
+					s.c.Debugf("Get Stops Error: %v %v", k, err)
+					return // Left nil
+				}
+
+				// Add to memcache
+				item := &memcache.Item{
+					Key:    cacheName,
+					Object: stop,
+				}
+
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					memcache.Gob.Set(s.c, item) // We do enough work below that this will finish
+				}()
+			}
+
+			// Add to list
+			stop.ID = id
+			stops[idx] = stop
+
+		}(i, id)
+	}
+
+	wg.Wait()
+
+	return stops, nil
+}
+
+func (s datastoreStore) AllStops() ([]*Stop, error) {
+	var stops []*Stop
+	keys, err := datastore.NewQuery("Stop").Order("__key__").GetAll(s.c, &stops)
+	if err != nil {
+		return nil, err
+	}
+
+	// Populate IDs
+	for i, stop := range stops {
+		stop.ID = keys[i].IntID()
+	}
+
+	return stops, nil
+}
+
+func (s datastoreStore) PutStop(stop *Stop) error {
+	k := datastore.NewKey(s.c, "Stop", "", stop.ID, nil)
+	_, err := datastore.Put(s.c, k, stop)
+	return err
+}
+
+func (s datastoreStore) Arrivals(stop int64, day time.Weekday) ([]*Arrival, error) {
+	cacheName := "arrivalCache:" + strconv.FormatInt(stop, 10) + ":" + day.String()
+	return s.arrivals(cacheName, stop, day.String()+" =", true)
+}
+
+func (s datastoreStore) ServiceArrivals(stop int64, serviceID string) ([]*Arrival, error) {
+	cacheName := "arrivalCache:" + strconv.FormatInt(stop, 10) + ":service:" + serviceID
+	return s.arrivals(cacheName, stop, "ServiceID =", serviceID)
+}
+
+// Arrivals at stop matching filter sorted by scheduled time
+func (s datastoreStore) arrivals(cacheName string, stop int64, filter string, value interface{}) ([]*Arrival, error) {
+	var dest []*Arrival
+
+	// Check memcache
+	if _, memError := memcache.Gob.Get(s.c, cacheName, &dest); memError == memcache.ErrCacheMiss {
+		// Query for arrival
+		parent := datastore.NewKey(s.c, "Stop", "", stop, nil)
+		q := datastore.NewQuery("Arrival").Ancestor(parent)
+		q = q.Filter(filter, value)
+		q = q.Order("Scheduled")
+
+		_, getError := q.GetAll(s.c, &dest)
+		if getError != nil {
+			return nil, getError // Probably invalid stop num
+		}
+
+		for _, arr := range dest {
+			arr.Stop = stop
+		}
+
+		// Add to memcache
+		item := &memcache.Item{
+			Key:    cacheName,
+			Object: dest,
+		}
+		memcache.Gob.Set(s.c, item)
+
+	} else if memError != nil {
+		return nil, memError
+	}
+
+	return dest, nil
+}
+
+func (s datastoreStore) PutArrivals(arrivals []*Arrival) error {
+	for start := 0; start < len(arrivals); start += datastoreBatchSize {
+		end := start + datastoreBatchSize
+		if end > len(arrivals) {
+			end = len(arrivals)
+		}
+
+		// Parent is stop associated with arrival
+		keys := make([]*datastore.Key, end-start)
+		for i, arr := range arrivals[start:end] {
+			stopKey := datastore.NewKey(s.c, "Stop", "", arr.Stop, nil)
+			keys[i] = datastore.NewIncompleteKey(s.c, "Arrival", stopKey)
+		}
+
+		if _, err := datastore.PutMulti(s.c, keys, arrivals[start:end]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s datastoreStore) Trips(ids []string) ([]*Trip, error) {
+	keys := make([]*datastore.Key, len(ids))
+	for i, id := range ids {
+		keys[i] = datastore.NewKey(s.c, "Trip", id, 0, nil)
+	}
+
+	trips := make([]*Trip, len(ids))
+	dest := make([]Trip, len(ids))
+	err := datastore.GetMulti(s.c, keys, dest)
+
+	// Unknown trips are left nil
+	multiErr, isMulti := err.(appengine.MultiError)
+	if err != nil && !isMulti {
+		return nil, err
+	}
+
+	for i := range dest {
+		if isMulti && multiErr[i] != nil {
+			if multiErr[i] != datastore.ErrNoSuchEntity {
+				return nil, multiErr[i]
+			}
+			continue
+		}
+
+		dest[i].ID = ids[i]
+		trips[i] = &dest[i]
+	}
+
+	return trips, nil
+}
+
+func (s datastoreStore) AllTrips() ([]*Trip, error) {
+	var trips []*Trip
+	keys, err := datastore.NewQuery("Trip").GetAll(s.c, &trips)
+	if err != nil {
+		return nil, err
+	}
+
+	// Populate IDs
+	for i, trip := range trips {
+		trip.ID = keys[i].StringID()
+	}
+
+	return trips, nil
+}
+
+func (s datastoreStore) PutTrips(trips []*Trip) error {
+	for start := 0; start < len(trips); start += datastoreBatchSize {
+		end := start + datastoreBatchSize
+		if end > len(trips) {
+			end = len(trips)
+		}
+
+		keys := make([]*datastore.Key, end-start)
+		for i, trip := range trips[start:end] {
+			keys[i] = datastore.NewKey(s.c, "Trip", trip.ID, 0, nil)
+		}
+
+		if _, err := datastore.PutMulti(s.c, keys, trips[start:end]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s datastoreStore) CalendarExceptions(date time.Time) ([]*CalendarException, error) {
+	var exceptions []*CalendarException
+
+	// Check memcache
+	cacheName := "calendarExceptions:" + date.Format("20060102")
+	if _, memError := memcache.Gob.Get(s.c, cacheName, &exceptions); memError == memcache.ErrCacheMiss {
+		_, err := datastore.NewQuery("CalendarException").Filter("Date =", date).GetAll(s.c, &exceptions)
+		if err != nil {
+			return nil, err
+		}
+
+		// Add to memcache
+		item := &memcache.Item{
+			Key:    cacheName,
+			Object: exceptions,
+		}
+		memcache.Gob.Set(s.c, item)
+
+	} else if memError != nil {
+		return nil, memError
+	}
+
+	return exceptions, nil
+}
+
+func (s datastoreStore) PutCalendarException(exception *CalendarException) error {
+	name := exception.ServiceID + "_" + exception.Date.Format("20060102")
+	k := datastore.NewKey(s.c, "CalendarException", name, 0, nil)
+	_, err := datastore.Put(s.c, k, exception)
+	return err
+}
+
+func (s datastoreStore) RouteNameOverrides() ([]*RouteNameOverride, error) {
+	overrides := []*RouteNameOverride{}
+	_, err := datastore.NewQuery("RouteNameOverride").Order("GTFS").GetAll(s.root, &overrides)
+	return overrides, err
+}
+
+func (s datastoreStore) PutRouteNameOverride(override *RouteNameOverride) error {
+	k := datastore.NewKey(s.root, "RouteNameOverride", override.GTFS, 0, nil)
+	_, err := datastore.Put(s.root, k, override)
+	return err
+}
+
+func (s datastoreStore) DeleteRouteNameOverride(gtfs string) error {
+	k := datastore.NewKey(s.root, "RouteNameOverride", gtfs, 0, nil)
+	return datastore.Delete(s.root, k)
+}
+
+func (s datastoreStore) Datasets() ([]*Dataset, error) {
+	datasets := []*Dataset{}
+	if _, err := datastore.NewQuery("Dataset").Order("-Version").GetAll(s.root, &datasets); err != nil {
+		return nil, err
+	}
+
+	var active activeDataset
+	k := datastore.NewKey(s.root, "ActiveDataset", "active", 0, nil)
+	if err := datastore.Get(s.root, k, &active); err != nil && err != datastore.ErrNoSuchEntity {
+		return nil, err
+	}
+
+	for _, dataset := range datasets {
+		dataset.Active = dataset.Version == active.Version
+	}
+
+	return datasets, nil
+}
+
+func (s datastoreStore) NewDataset() (Store, error) {
+	dataset := newDataset()
+
+	k := datastore.NewKey(s.root, "Dataset", dataset.Version, 0, nil)
+	if _, err := datastore.Put(s.root, k, dataset); err != nil {
+		return nil, err
+	}
+
+	return s.dataset(dataset.Version)
+}
+
+func (s datastoreStore) Activate(version string) error {
+	k := datastore.NewKey(s.root, "Dataset", version, 0, nil)
+	if err := datastore.Get(s.root, k, new(Dataset)); err == datastore.ErrNoSuchEntity {
+		return errUnknownDataset
+	} else if err != nil {
+		return err
+	}
+
+	// Single entity -- switch is atomic
+	activeKey := datastore.NewKey(s.root, "ActiveDataset", "active", 0, nil)
+	if _, err := datastore.Put(s.root, activeKey, &activeDataset{Version: version}); err != nil {
+		return err
+	}
+
+	return memcache.Delete(s.root, activeDatasetCache)
+}
+
+// Removes all entities in namespace of dataset
+func (s datastoreStore) DeleteDataset(version string) error {
+	datasets, err := s.Datasets()
+	if err != nil {
+		return err
+	}
+
+	for _, dataset := range datasets {
+		if dataset.Version == version && dataset.Active {
+			return errActiveDataset
+		}
+	}
+
+	if version == "" {
+		return errUnknownDataset
+	}
+
+	ds, err := s.dataset(version)
+	if err != nil {
+		return err
+	}
+
+	keys, err := datastore.NewQuery("").KeysOnly().GetAll(ds.c, nil)
+	if err != nil {
+		return err
+	}
+
+	//Delete these keys
+	for start := 0; start < len(keys); start += datastoreBatchSize {
+		end := start + datastoreBatchSize
+		if end > len(keys) {
+			end = len(keys)
+		}
+
+		if err := datastore.DeleteMulti(ds.c, keys[start:end]); err != nil {
+			return err
+		}
+	}
+
+	k := datastore.NewKey(s.root, "Dataset", version, 0, nil)
+	return datastore.Delete(s.root, k)
+}
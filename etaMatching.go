@@ -0,0 +1,108 @@
+package corvallisbus
+
+import (
+	"sort"
+	"time"
+)
+
+// ETAs farther than this from a scheduled arrival of the same route are not matched
+const etaMatchWindow = 30 * time.Minute
+
+// Scheduled arrival with realtime ETA of the same bus
+type arrivalMatch struct {
+	arrival *Arrival
+	eta     *ETA
+}
+
+// Arrivals at a stop after combining schedule and realtime information
+type stopArrivals struct {
+	matched            []*arrivalMatch
+	unmatchedETAs      []*ETA     // No scheduled arrival of the route close enough
+	unmatchedSchedules []*Arrival // No ETA (not running yet or no realtime information)
+}
+
+// Pairs each ETA with the closest scheduled arrival of the same route
+//
+// scheds can start up to etaMatchWindow before now so late buses are matched.
+// Scheduled arrivals before now without an ETA have already left and are dropped.
+func matchArrivals(scheds []*Arrival, etas []*ETA, now time.Duration) *stopArrivals {
+	result := &stopArrivals{
+		matched:            []*arrivalMatch{},
+		unmatchedETAs:      []*ETA{},
+		unmatchedSchedules: []*Arrival{},
+	}
+
+	// Group by route -- ETAs in order of arrival
+	routeScheds := make(map[string][]*Arrival)
+	for _, arr := range scheds {
+		routeScheds[arr.Route] = append(routeScheds[arr.Route], arr)
+	}
+
+	routeETAs := make(map[string][]*ETA)
+	for _, eta := range etas {
+		routeETAs[eta.route] = append(routeETAs[eta.route], eta)
+	}
+
+	used := make(map[*Arrival]bool)
+	for route, etas := range routeETAs {
+		sort.Sort(byExpected(etas))
+
+		candidates := routeScheds[route]
+		next := 0 // Buses don't pass each other -- later ETAs match later arrivals
+		for _, eta := range etas {
+			best := -1
+			for i := next; i < len(candidates); i++ {
+				diff := absDuration(eta.expected - candidates[i].Scheduled)
+				if diff > etaMatchWindow {
+					if candidates[i].Scheduled > eta.expected {
+						break // Sorted -- only getting farther
+					}
+					continue
+				}
+
+				if best == -1 || diff < absDuration(eta.expected-candidates[best].Scheduled) {
+					best = i
+				}
+			}
+
+			if best == -1 {
+				result.unmatchedETAs = append(result.unmatchedETAs, eta)
+				continue
+			}
+
+			used[candidates[best]] = true
+			result.matched = append(result.matched, &arrivalMatch{arrival: candidates[best], eta: eta})
+			next = best + 1
+		}
+	}
+
+	for _, arr := range scheds {
+		if !used[arr] && arr.Scheduled >= now {
+			result.unmatchedSchedules = append(result.unmatchedSchedules, arr)
+		}
+	}
+
+	sort.Sort(matchesByExpected(result.matched))
+	sort.Sort(byExpected(result.unmatchedETAs))
+
+	return result
+}
+
+func absDuration(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
+
+type byExpected []*ETA
+
+func (a byExpected) Len() int           { return len(a) }
+func (a byExpected) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byExpected) Less(i, j int) bool { return a[i].expected < a[j].expected }
+
+type matchesByExpected []*arrivalMatch
+
+func (a matchesByExpected) Len() int           { return len(a) }
+func (a matchesByExpected) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a matchesByExpected) Less(i, j int) bool { return a[i].eta.expected < a[j].eta.expected }
@@ -0,0 +1,158 @@
+package corvallisbus
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Background polling of realtime ETAs for every platform
+//
+// Requests read the latest poll instead of calling Connexionz (or downloading
+// GTFS-Realtime feeds) themselves, so busy stops don't multiply upstream
+// calls. ETAs older than the staleness budget aren't used -- arrivals fall
+// back to the schedule while the poller is unhealthy (upstream down, poll
+// stuck) or before the first poll is complete.
+//
+// Needs a long running process (cmd/corvallis-bus) -- App Engine frontend
+// instances can't run background goroutines and fetch ETAs for each request.
+
+const etaPollWorkers = 8 // Concurrent ETA requests during a poll
+
+type etaPoller struct {
+	interval  time.Duration
+	staleness time.Duration // Maximum age of ETAs used by requests
+
+	lock     sync.RWMutex // Guards snapshot -- read by requests, written by the poll
+	snapshot *etaSnapshot // Latest poll -- replaced after each poll
+}
+
+type etaSnapshot struct {
+	polled    time.Time // End of poll
+	platforms map[int64]*platformETAs
+}
+
+// ETAs of a platform at time fetched
+type platformETAs struct {
+	fetched  time.Time
+	arrivals []*realtimeArrival
+}
+
+// Poller used by every Context -- nil when requests fetch ETAs themselves
+var globalETAPoller *etaPoller
+
+// Polls ETAs of every platform each interval in the background
+func StartETAPoller(c Context, interval, staleness time.Duration) {
+	source := realtimeSource(c)
+	p := &etaPoller{interval: interval, staleness: staleness}
+	globalETAPoller = p
+
+	go func() {
+		for {
+			start := time.Now()
+			p.poll(c, source)
+
+			if wait := interval - time.Since(start); wait > 0 {
+				time.Sleep(wait)
+			}
+		}
+	}()
+}
+
+// Latest polled ETAs of platform -- error when stale so arrivals use the schedule
+func (p *etaPoller) ETA(platform int64) ([]*Prediction, error) {
+	snapshot := p.latest()
+	if snapshot == nil {
+		return nil, errors.New("No ETAs polled yet")
+	}
+
+	etas, ok := snapshot.platforms[platform]
+	if !ok {
+		return nil, fmt.Errorf("No ETAs polled for platform %d", platform)
+	}
+
+	now := time.Now()
+	if age := now.Sub(etas.fetched); age > p.staleness {
+		return nil, fmt.Errorf("ETAs of platform %d are stale (%v old)", platform, age)
+	}
+
+	return realtimePredictions(etas.arrivals, now), nil
+}
+
+// Fetches ETAs of every platform -- platforms that fail keep their previous ETAs
+func (p *etaPoller) poll(c Context, source RealtimeProvider) {
+	start := time.Now()
+	index, err := cachedStopIndex(c)
+	if err != nil {
+		c.Errorf("ETA Poll Error: %v", err)
+		return
+	}
+
+	previous := p.latest()
+	snapshot := &etaSnapshot{platforms: make(map[int64]*platformETAs)}
+	failed := 0
+
+	var wg sync.WaitGroup
+	locker := new(sync.Mutex)
+	platforms := make(chan int64)
+	for i := 0; i < etaPollWorkers; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+			for platform := range platforms {
+				predictions, err := source.ETA(platform)
+				fetched := time.Now()
+
+				// Add to map -- mutex protected
+				locker.Lock()
+				if err == nil {
+					snapshot.platforms[platform] = newPlatformETAs(predictions, fetched)
+				} else {
+					failed++
+					if previous != nil && previous.platforms[platform] != nil {
+						snapshot.platforms[platform] = previous.platforms[platform] // Ages until stale
+					}
+				}
+				locker.Unlock()
+			}
+		}()
+	}
+
+	for platform := range index.stops {
+		platforms <- platform
+	}
+	close(platforms)
+	wg.Wait()
+
+	snapshot.polled = time.Now()
+	p.lock.Lock()
+	p.snapshot = snapshot
+	p.lock.Unlock()
+
+	if failed > 0 {
+		c.Warningf("ETA Poll: %d of %d platforms failed", failed, len(index.stops))
+	}
+	c.Debugf("ETA Poll: %d platforms in %v", len(index.stops), snapshot.polled.Sub(start))
+}
+
+// Latest poll -- nil before the first poll is complete
+func (p *etaPoller) latest() *etaSnapshot {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	return p.snapshot
+}
+
+// Minutes until arrival as time of arrival
+func newPlatformETAs(predictions []*Prediction, fetched time.Time) *platformETAs {
+	etas := &platformETAs{fetched: fetched, arrivals: make([]*realtimeArrival, len(predictions))}
+	for i, prediction := range predictions {
+		etas.arrivals[i] = &realtimeArrival{
+			route:    prediction.Route,
+			expected: fetched.Add(time.Duration(prediction.Minutes) * time.Minute),
+		}
+	}
+
+	return etas
+}
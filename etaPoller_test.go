@@ -0,0 +1,88 @@
+package corvallisbus
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// ETAs for tests -- platforms in failing return an error
+type testRealtime struct {
+	lock    sync.Mutex
+	failing map[int64]bool
+}
+
+func (r *testRealtime) ETA(platform int64) ([]*Prediction, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.failing[platform] {
+		return nil, errors.New("upstream down")
+	}
+	return []*Prediction{{Route: "1", Minutes: int(platform)}}, nil
+}
+
+func (r *testRealtime) fail(platform int64) {
+	r.lock.Lock()
+	r.failing[platform] = true
+	r.lock.Unlock()
+}
+
+func TestETAPoller(t *testing.T) {
+	c := &testContext{t: t, store: &testStore{
+		version: "eta-poller",
+		stops:   []*Stop{{ID: 1, Lat: 44.5646, Long: -123.2620}, {ID: 2, Lat: 44.5900, Long: -123.2800}},
+	}}
+	source := &testRealtime{failing: make(map[int64]bool)}
+	p := &etaPoller{interval: time.Second, staleness: time.Hour}
+
+	if _, err := p.ETA(1); err == nil {
+		t.Error("before first poll: expected error")
+	}
+
+	// Requests read while polls publish snapshots (go test -race)
+	var wg sync.WaitGroup
+	done := make(chan bool)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				p.ETA(1)
+			}
+		}
+	}()
+	for i := 0; i < 5; i++ {
+		p.poll(c, source)
+	}
+	close(done)
+	wg.Wait()
+
+	predictions, err := p.ETA(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(predictions) != 1 || predictions[0].Minutes != 2 {
+		t.Errorf("got %v, want 2 minutes", predictions)
+	}
+
+	// Failed platforms keep their previous ETAs until stale
+	source.fail(2)
+	p.poll(c, source)
+	if _, err := p.ETA(2); err != nil {
+		t.Errorf("failed poll: %v", err)
+	}
+
+	p.staleness = 0
+	if _, err := p.ETA(2); err == nil {
+		t.Error("stale ETAs: expected error")
+	}
+
+	if _, err := p.ETA(3); err == nil {
+		t.Error("unknown platform: expected error")
+	}
+}
@@ -0,0 +1,156 @@
+package corvallisbus
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/csv"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Google Transit Feed -- set of files (routes.txt, trips.txt, ...)
+//
+// Can be downloaded (GoogleTransitURL) or read from local disk as a zip file
+// or an unpacked directory.
+type Feed interface {
+	Open(name string) (io.ReadCloser, error)
+	Close() error
+}
+
+// Opens feed at path -- zip file or unpacked directory
+func OpenFeed(feedPath string) (Feed, error) {
+	info, err := os.Stat(feedPath)
+	if err != nil {
+		return nil, err
+	}
+
+	if info.IsDir() {
+		return dirFeed(feedPath), nil
+	}
+
+	zipFile, err := zip.OpenReader(feedPath)
+	if err != nil {
+		return nil, err
+	}
+
+	return newZipFeed(&zipFile.Reader, zipFile), nil
+}
+
+// Downloads feed from GoogleTransitURL
+func downloadFeed(c Context) (Feed, error) {
+	resp, err := c.HTTPClient().Get(GoogleTransitURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return nil, &UpstreamError{URL: GoogleTransitURL, Status: resp.Status}
+	}
+
+	bs, errRead := ioutil.ReadAll(resp.Body)
+	if errRead != nil {
+		return nil, errRead
+	}
+
+	// Unzip
+	reader, err := zip.NewReader(bytes.NewReader(bs), int64(len(bs)))
+	if err != nil {
+		return nil, err
+	}
+
+	return newZipFeed(reader, nil), nil
+}
+
+// CSV reader for a file in feed -- file is read into memory and closed
+func feedReader(feed Feed, name string) (*csv.Reader, error) {
+	f, err := feed.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	bs, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+
+	return csv.NewReader(bytes.NewReader(bs)), nil
+}
+
+// Map column name -> index from header record
+func columnIndex(header []string) map[string]int {
+	columns := make(map[string]int)
+	for i, name := range header {
+		// Byte order mark is sometimes left on the first column
+		name = strings.TrimSpace(strings.TrimPrefix(name, "\ufeff"))
+		columns[name] = i
+	}
+
+	return columns
+}
+
+// Determine if all names are present in columns
+func hasColumns(columns map[string]int, names ...string) bool {
+	for _, name := range names {
+		if _, ok := columns[name]; !ok {
+			return false
+		}
+	}
+
+	return true
+}
+
+//
+// Implementations
+//
+
+type zipFeed struct {
+	files  map[string]*zip.File // Base name -> file
+	closer io.Closer
+}
+
+func newZipFeed(r *zip.Reader, closer io.Closer) *zipFeed {
+	feed := &zipFeed{
+		files:  make(map[string]*zip.File),
+		closer: closer,
+	}
+
+	// Files are sometimes zipped inside a folder
+	for _, f := range r.File {
+		feed.files[path.Base(f.Name)] = f
+	}
+
+	return feed
+}
+
+func (z *zipFeed) Open(name string) (io.ReadCloser, error) {
+	f, ok := z.files[name]
+	if !ok {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+
+	return f.Open()
+}
+
+func (z *zipFeed) Close() error {
+	if z.closer == nil {
+		return nil
+	}
+
+	return z.closer.Close()
+}
+
+type dirFeed string
+
+func (d dirFeed) Open(name string) (io.ReadCloser, error) {
+	return os.Open(filepath.Join(string(d), name))
+}
+
+func (d dirFeed) Close() error {
+	return nil
+}
@@ -1,77 +1,119 @@
 package corvallisbus
 
 import (
-	"archive/zip"
-	"bytes"
 	"encoding/csv"
-
-	"appengine"
-	"appengine/datastore"
-	//"github.com/jlaffaye/ftp"
-	"io"
-	"io/ioutil"
+	"errors"
 	"os"
 	"sort"
 	"strconv"
 	"strings"
 	"time"
-
-	"appengine/urlfetch"
 )
 
+// Location of the CTS Google Transit Feed zip file
+var GoogleTransitURL = "https://dl.dropboxusercontent.com/u/3107589/Google_Transit.zip"
+
 /*
- * Uses Zip file at with General Transit Feed Specification
+ * Uses feed (zip file or directory) with General Transit Feed Specification
  *    https://developers.google.com/transit/gtfs/reference?csw=1
  *
- * Schedule (calendar.txt)
+ * Stop mapping (stops.txt)
+ * Route name mapping (routes.txt, trips.txt, overrides)
+ * Schedule (calendar.txt -- optional with calendar_dates.txt)
  * Scheduled Arrivals (stop_times.txt)
  * Route color (routes.txt)
+ * Route polylines (shapes.txt)
  * Service Exceptions (calendar_dates.txt)
  */
-func updateWithGoogleTransit(c appengine.Context, tagToNumber map[int64]int64, routeNameConversion map[string]string) error {
-
-	// Download zip file
-	zipFile, zipError := downloadInformation(c)
-	if zipError != nil {
-		return zipError
-	}
-
-	//Convert into map between filename and information
-	fileMap := make(map[string]io.ReadCloser)
-	for _, f := range zipFile.File {
-		r, _ := f.Open()
-		defer r.Close()
-		fileMap[f.Name] = r
-	}
+func updateWithGoogleTransit(c Context, feed Feed, platforms []*Platform, patterns []*Pattern, overrides []*RouteNameOverride, report *ImportReport) error {
 
 	// Create route map -- used througout
-	keyMap, routeMap := createRouteMap(c)
+	routeMap := createRouteMap(c)
 
 	//
 	// Use each file to provide particular information (reference by filename)
 	//
 
-	r := csv.NewReader(fileMap["routes.txt"])
-	updateRoutes(c, r, keyMap, routeMap, routeNameConversion)
+	// Create mapping between stop_id -> platform number
+	r, err := feedReader(feed, "stops.txt")
+	if err != nil {
+		return err
+	}
+	stopIDToNumber := newStopMatcher(r, platforms, patterns)
+
+	// Create mapping between trip_id -> sched_info
+	if r, err = feedReader(feed, "stop_times.txt"); err != nil {
+		return err
+	}
+	scheduleRouteMap := processStopTimes(r)
+
+	// Create mapping between route_id -> connexionz route name
+	if r, err = feedReader(feed, "routes.txt"); err != nil {
+		return err
+	}
+	gtfsRoutes := processRouteNames(r)
+
+	if r, err = feedReader(feed, "trips.txt"); err != nil {
+		return err
+	}
+	routePlats := routePlatforms(r, scheduleRouteMap, stopIDToNumber)
+
+	routeNameConversion, unmappedRoutes := mapRouteNames(gtfsRoutes, routePlats, stopIDToNumber, overrides)
+	report.RouteNames = routeNameConversion
+	report.UnmappedRoutes = unmappedRoutes
+
+	if r, err = feedReader(feed, "routes.txt"); err != nil {
+		return err
+	}
+	updateRoutes(c, r, routeMap, routeNameConversion)
 
 	// trips.txt (route_id[0],service_id[1],trip_id[2])
 	// Find mappings between values that are only present in GT information
 
-	r = csv.NewReader(fileMap["trips.txt"])
-	tripIDMap, tripIDToServiceID := processTrips(r, routeNameConversion)
+	if r, err = feedReader(feed, "trips.txt"); err != nil {
+		return err
+	}
+	tripIDMap, tripIDToServiceID, tripIDToHeadsign := processTrips(r, routeNameConversion)
+
+	// Read all calendar information -- feeds can list every date in calendar_dates.txt instead
+	calendarMap := make(map[string]TimeInfo)
+	hasCalendars := false
+	if r, err = feedReader(feed, "calendar.txt"); err == nil {
+		calendarMap = processCalendars(r)
+		hasCalendars = true
+	} else if !os.IsNotExist(err) {
+		return err
+	}
 
-	// Read all calendar information
-	r = csv.NewReader(fileMap["calendar.txt"])
-	calendarMap := processCalendars(r)
+	// Read service exceptions (holidays, breaks) -- optional file with calendar.txt
+	if r, err = feedReader(feed, "calendar_dates.txt"); err == nil {
+		if err = processCalendarExceptions(c, r); err != nil {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	} else if !hasCalendars {
+		return errors.New("Feed has neither calendar.txt nor calendar_dates.txt")
+	}
 
-	// Create mapping between trip_id -> sched_info
-	r = csv.NewReader(fileMap["stop_times.txt"])
-	scheduleRouteMap := processStopTimes(r)
+	// Route polylines -- optional file, Connexionz polylines are kept otherwise
+	shapes := make(map[string][]*ShapePoint)
+	tripShapes := make(map[string]string)
+	if r, err = feedReader(feed, "shapes.txt"); err == nil {
+		shapes = processShapes(r)
+		if r, err = feedReader(feed, "trips.txt"); err != nil {
+			return err
+		}
+		updatePolylines(c, r, shapes, routeMap, routeNameConversion, scheduleRouteMap, stopIDToNumber)
 
-	// Create map between stop_id -> platform number
-	transFile, _ := os.Open("idToNumber.csv")
-	r = csv.NewReader(transFile)
-	stopIDToNumber := processStopIDToStopNum(r)
+		// Shape of each trip -- used to estimate times of untimed stops
+		if r, err = feedReader(feed, "trips.txt"); err != nil {
+			return err
+		}
+		tripShapes = processTripShapes(r)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
 
 	//
 	// Combine all information from above into schedule
@@ -79,10 +121,13 @@ func updateWithGoogleTransit(c appengine.Context, tagToNumber map[int64]int64, r
 
 	c.Infof("Found %d trips", len(scheduleRouteMap))
 
+	store := c.Store()
+	trips := []*Trip{}
+
 	// Loop over each sub-route -- sort SchedInfo
 	for trip_id, stops := range scheduleRouteMap {
 
-		// Get related Route from datastore
+		// Get related Route from store
 		connexionzRouteName, ok := tripIDMap[trip_id]
 		if !ok {
 			continue // Not a route that we handle
@@ -94,66 +139,92 @@ func updateWithGoogleTransit(c appengine.Context, tagToNumber map[int64]int64, r
 		// Lookups
 		//
 
-		route := routeMap[connexionzRouteName]  // Route by Connexionz name
-		routeKey := keyMap[connexionzRouteName] // Key for above route
+		route, ok := routeMap[connexionzRouteName] // Route by Connexionz name
+		if !ok {
+			c.Warningf("Unknown Connexionz route %s for trip %s", connexionzRouteName, trip_id)
+			continue
+		}
 
-		days := calendarMap[tripIDToServiceID[trip_id]].days
+		serviceID := tripIDToServiceID[trip_id]
+		calendar, hasCalendar := calendarMap[serviceID]
+		days := calendar.days
+		if !hasCalendar {
+			days = make([]bool, 7) // Only in calendar_dates.txt -- runs on added dates only
+		}
 
-		// Add start & end information on route (might happen multiple times)
-		route.Start = calendarMap[tripIDToServiceID[trip_id]].start
-		route.End = calendarMap[tripIDToServiceID[trip_id]].end
-		datastore.Put(c, routeKey, route)
+		// Add start & end information on route (might happen multiple times -- stored below)
+		if hasCalendar {
+			route.Start = calendar.start
+			route.End = calendar.end
+		}
 
 		// Sort arrivals by stop sequence
 		sort.Sort(ByID(stops))
 
-		// Enter initial point --Arrival Objects (parent is stop)
-		createArrival(c, stops[0], true, routeKey, route.Name, stopIDToNumber, days)
-
-		// Shouldn't have to get to the last one (len(stops)-1) because that one should be known
-		for i := 0; i < len(stops)-1; i++ {
-			if stops[i].arrive != 0 {
-
-				//Keep going until we find next known point
-				var j int
-				for j = i + 1; j < len(stops)-1; j++ {
-					if stops[j].arrive != 0 {
-						break
-					}
-				}
-
-				// j is equal to index of next zero
-				diff := j - i
-				diffSeconds := (stops[j].arrive - stops[i].arrive).Seconds()
+		// Times in stop_times.txt -- others are estimated below
+		timed := make([]bool, len(stops))
+		for k, stop := range stops {
+			timed[k] = stop.arrive != 0
+		}
 
-				changeSeconds := int(diffSeconds) / diff
-				changeDir := time.Duration(time.Duration(changeSeconds) * time.Second)
+		// Will always have known point at start and end
+		if !timed[0] || !timed[len(stops)-1] {
+			c.Errorf("Unexpected behavior in scheduleRoute: %s (%v)", route.Name, stops)
+		}
 
-				// Enter middle points
-				for midI := i + 1; midI < j; midI++ {
-					stop := stops[midI]
+		// Estimate times between known points by distance along the trip
+		dists := stopDistances(stops, shapes[tripShapes[trip_id]], stopIDToNumber)
+		interpolateStopTimes(stops, timed, dists)
 
-					// Modify time
-					stop.arrive = stops[i].arrive + time.Duration(midI-i)*changeDir
-					createArrival(c, stop, false, routeKey, route.Name, stopIDToNumber, days)
-				}
+		// Arrival Objects (parent is stop) -- not for the last stop (bus doesn't leave)
+		arrivals := []*Arrival{}
+		for k, stop := range stops[:len(stops)-1] {
+			arrivals = appendArrival(arrivals, stop, timed[k], route.Name, stopIDToNumber, serviceID, days)
+		}
+		c.Debugf("Skipping: %s %v", route.Name, stops[len(stops)-1])
 
-				i = j - 1 // Move to next chunk -- used next loop
+		// Destination shown on bus -- same for whole trip
+		for _, arr := range arrivals {
+			arr.Headsign = tripIDToHeadsign[trip_id]
+			arr.TripID = trip_id
+		}
 
-				// Create arrival -- only if is not last in route
-				if j < (len(stops) - 1) {
-					createArrival(c, stops[j], true, routeKey, route.Name, stopIDToNumber, days)
-				} else {
-					c.Debugf("Skipping:", route.Name, stops[j])
-				}
+		if err := store.PutArrivals(arrivals); err != nil {
+			c.Errorf("Arrival Put Error (%s): %v", trip_id, err)
+		}
 
-			} else {
-				// Will always have known point at start and end
-				c.Errorf("Unexpected behavior in scheduleRoute: %s (%s)", route.Name, stops[i])
+		// Whole trip -- including last stop & stops unknown to Connexionz
+		trip := &Trip{
+			ID:        trip_id,
+			ServiceID: serviceID,
+			Route:     route.Name,
+			Headsign:  tripIDToHeadsign[trip_id],
+			StopTimes: make([]StopTime, len(stops)),
+			Days:      days,
+		}
+		for k, stop := range stops {
+			stopNum, _ := stopIDToNumber.platform(stop.name, route.Name)
+			trip.StopTimes[k] = StopTime{
+				StopID:      stop.name,
+				Stop:        stopNum,
+				Scheduled:   stop.arrive,
+				IsScheduled: timed[k],
 			}
 		}
+		trips = append(trips, trip)
+	}
+
+	if err := store.PutTrips(trips); err != nil {
+		return err
+	}
+
+	// Save start & end information
+	for _, route := range routeMap {
+		store.PutRoute(route)
 	}
 
+	report.UnmatchedStops = stopIDToNumber.report()
+
 	return nil
 }
 
@@ -161,62 +232,20 @@ func updateWithGoogleTransit(c appengine.Context, tagToNumber map[int64]int64, r
 // Internal functions
 //
 
-func downloadInformation(c appengine.Context) (*zip.Reader, error) {
-
-	/*
-		// Connect to ftp
-		ftpCon, connErr := ftp.Connect("ftp.ci.corvallis.or.us:21") // Port 21 in default for FTP
-		if connErr != nil {
-			c.Errorf("Zip Read Error (FTP Connect): ", connErr)
-			return nil, connErr
-		}
-
-		// Login (Need to do but doesn't matter values)
-		errLogin := ftpCon.Login("anonymous", "anonymous")
-		if errLogin != nil {
-			c.Errorf("Zip Login Error (FTP Login): ", errLogin)
-			return nil, errLogin
-		}
-
-		file, err := ftpCon.Retr("/pw/Transportation/GoogleTransitFeed/Google_Transit.zip")
-		if err != nil {
-			c.Errorf("Zip Read Error (FTP): ", err)
-			return nil, err
-		}
-	*/
-
-	client := urlfetch.Client(c)
-	resp, _ := client.Get("https://dl.dropboxusercontent.com/u/3107589/Google_Transit.zip")
-
-	bs, errRead := ioutil.ReadAll(resp.Body)
-	//file.Close()
-	if errRead != nil {
-		c.Errorf("Zip Read Error: ", errRead)
-		return nil, errRead
-	}
-
-	// Unzip
-	reader := bytes.NewReader(bs)
-	return zip.NewReader(reader, int64(len(bs)))
-}
-
-func createRouteMap(c appengine.Context) (map[string]*datastore.Key, map[string]*Route) {
-	// Read all routes from datastore
-	var routes []*Route
-	keys, _ := datastore.NewQuery("Route").GetAll(c, &routes)
+func createRouteMap(c Context) map[string]*Route {
+	// Read all routes from store
+	routes, _ := c.Store().Routes()
 
 	// Convert to map -- easier access
 	routeMap := make(map[string]*Route)
-	keyMap := make(map[string]*datastore.Key)
-	for i, route := range routes {
+	for _, route := range routes {
 		routeMap[route.Name] = route
-		keyMap[route.Name] = keys[i] // Store key for storing later
 	}
 
-	return keyMap, routeMap
+	return routeMap
 }
 
-func updateRoutes(c appengine.Context, r *csv.Reader, keyMap map[string]*datastore.Key, routeMap map[string]*Route, routeNameConversion map[string]string) {
+func updateRoutes(c Context, r *csv.Reader, routeMap map[string]*Route, routeNameConversion map[string]string) {
 	// routes.txt (color, long name, description, url)
 	records, _ := r.ReadAll()
 
@@ -241,27 +270,38 @@ func updateRoutes(c appengine.Context, r *csv.Reader, keyMap map[string]*datasto
 		route.URL = record[6]
 		route.Color = record[7]
 
-		// Update in datastore
-		datastore.Put(c, keyMap[route.Name], route)
+		// Update in store
+		c.Store().PutRoute(route)
 	}
 }
 
-func processTrips(r *csv.Reader, routeNameConversion map[string]string) (map[string]string, map[string]string) {
+func processTrips(r *csv.Reader, routeNameConversion map[string]string) (map[string]string, map[string]string, map[string]string) {
 	records, _ := r.ReadAll()
 
 	// Create map: trip_id -> connexionz route name
 	tripIDMap := make(map[string]string)
 	tripIDToServiceID := make(map[string]string)
+	tripIDToHeadsign := make(map[string]string)
+
+	if len(records) == 0 {
+		return tripIDMap, tripIDToServiceID, tripIDToHeadsign
+	}
+
+	// trip_headsign is optional
+	headsignCol, hasHeadsign := columnIndex(records[0])["trip_headsign"]
 
 	for _, record := range records[1:] {
 		connexionzRouteName, ok := routeNameConversion[record[0]]
 		if ok {
 			tripIDMap[record[2]] = connexionzRouteName
 			tripIDToServiceID[record[2]] = record[1]
+			if hasHeadsign {
+				tripIDToHeadsign[record[2]] = record[headsignCol]
+			}
 		}
 	}
 
-	return tripIDMap, tripIDToServiceID
+	return tripIDMap, tripIDToServiceID, tripIDToHeadsign
 }
 
 // Used to represent time information from caledars.txt
@@ -287,7 +327,7 @@ func processCalendars(r *csv.Reader) map[string]TimeInfo {
 		//
 		// Extract start and end dates and add to route
 		//
-		loc, _ := time.LoadLocation("US/Pacific")
+		loc := pacificLocation()
 		start, _ := time.ParseInLocation("20060102", cal[8], loc)
 		end, _ := time.ParseInLocation("20060102", cal[9], loc)
 
@@ -301,11 +341,45 @@ func processCalendars(r *csv.Reader) map[string]TimeInfo {
 	return calendarMap
 }
 
+func processCalendarExceptions(c Context, r *csv.Reader) error {
+	records, err := r.ReadAll()
+	if err != nil || len(records) == 0 {
+		return err
+	}
+
+	loc := pacificLocation()
+	store := c.Store()
+
+	// service_id[0], date[1], exception_type[2]
+	for _, record := range records[1:] {
+		date, dateErr := time.ParseInLocation("20060102", record[1], loc)
+		exceptionType, typeErr := strconv.Atoi(record[2])
+		if dateErr != nil || typeErr != nil {
+			c.Errorf("Invalid calendar exception: %v", record)
+			continue
+		}
+
+		exception := &CalendarException{
+			ServiceID: record[0],
+			Type:      int8(exceptionType),
+			Date:      date,
+		}
+
+		if err := store.PutCalendarException(exception); err != nil {
+			c.Errorf("CalendarException Put Error: %v", err)
+		}
+	}
+
+	return nil
+}
+
 // Temp structure for schedule input
 type SchedInfo struct {
-	arrive time.Duration
-	id     int
-	name   string
+	arrive  time.Duration
+	id      int
+	name    string
+	dist    float64 // shape_dist_traveled
+	hasDist bool
 }
 
 type ByID []*SchedInfo
@@ -318,6 +392,12 @@ func processStopTimes(r *csv.Reader) map[string]([]*SchedInfo) {
 	records, _ := r.ReadAll()
 
 	scheduleRouteMap := make(map[string]([]*SchedInfo)) // trip_id -> SchedInfo
+	if len(records) == 0 {
+		return scheduleRouteMap
+	}
+
+	// shape_dist_traveled is optional
+	distCol, hasDist := columnIndex(records[0])["shape_dist_traveled"]
 
 	// Build map of schedule points
 	// trip_id[0],arrival_time[1], departure_time[2], stop_id[3]
@@ -332,6 +412,12 @@ func processStopTimes(r *csv.Reader) map[string]([]*SchedInfo) {
 			name:   record[3],
 		}
 
+		if hasDist && record[distCol] != "" {
+			if dist, err := strconv.ParseFloat(record[distCol], 64); err == nil {
+				newS.dist, newS.hasDist = dist, true
+			}
+		}
+
 		schedSlice, ok := scheduleRouteMap[record[0]]
 		if !ok {
 			// Make new entry for this trip_id
@@ -372,39 +458,21 @@ func timeOfDayStringToDuration(t string) time.Duration {
 	return tTime
 }
 
-func processStopIDToStopNum(r *csv.Reader) map[string]int64 {
-	stopIDToNumber := make(map[string]int64)
-	records, _ := r.ReadAll()
-
-	// stop_id[0], stop_number[1]
-	for _, record := range records[1:] {
-		if record[1] != "" {
-			num, _ := strconv.Atoi(record[1])
-			stopIDToNumber[record[0]] = int64(num)
-		}
-	}
-	return stopIDToNumber
-}
+// Adds arrival at stop to arrivals -- skipped if stop isn't known to Connexionz
+func appendArrival(arrivals []*Arrival, stop *SchedInfo, isScheduled bool, routeName string, stopIDToNumber *stopMatcher, serviceID string, days []bool) []*Arrival {
 
-func createArrival(c appengine.Context, stop *SchedInfo, isScheduled bool, routeKey *datastore.Key, routeName string, stopIDToNumber map[string]int64, days []bool) error {
-
-	// Modify for Downtown Transit Center special case
-	if stop.name == "MonroeAve_S_5thSt" {
-		stop.name = routeName + "_" + stop.name
-	}
-
-	stopNum, ok := stopIDToNumber[stop.name]
+	stopNum, ok := stopIDToNumber.platform(stop.name, routeName)
 	if !ok {
 		//c.Errorf("Unknown stop: %s", stop.name)
-		return nil // Stops are not guarenteeded to be in both datasources
+		return arrivals // Stops are not guarenteeded to be in both datasources
 	}
 
-	stopKey := datastore.NewKey(c, "Stop", "", stopNum, nil)
-	newArrivalKey := datastore.NewIncompleteKey(c, "Arrival", stopKey)
-	newArrival := Arrival{
-		Route:       routeKey,
+	newArrival := &Arrival{
+		Stop:        stopNum,
+		Route:       routeName,
 		Scheduled:   stop.arrive,
 		IsScheduled: isScheduled,
+		ServiceID:   serviceID,
 		Monday:      days[0],
 		Tuesday:     days[1],
 		Wednesday:   days[2],
@@ -414,7 +482,5 @@ func createArrival(c appengine.Context, stop *SchedInfo, isScheduled bool, route
 		Sunday:      days[6],
 	}
 
-	datastore.Put(c, newArrivalKey, &newArrival)
-
-	return nil
+	return append(arrivals, newArrival)
 }
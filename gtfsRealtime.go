@@ -0,0 +1,464 @@
+package corvallisbus
+
+// GTFS-Realtime messages (protocol buffers)
+//   - https://developers.google.com/transit/gtfs-realtime/reference
+//
+// Only the fields used by this server. Field numbers are from
+// gtfs-realtime.proto -- JSON names match the proto field names.
+
+import (
+	"errors"
+	"fmt"
+)
+
+const gtfsRealtimeVersion = "2.0"
+
+type feedMessage struct {
+	Header *feedHeader   `json:"header"`
+	Entity []*feedEntity `json:"entity"`
+}
+
+type feedHeader struct {
+	GtfsRealtimeVersion string `json:"gtfs_realtime_version"`
+	Incrementality      int    `json:"incrementality"` // 0 = FULL_DATASET
+	Timestamp           uint64 `json:"timestamp"`      // POSIX time
+}
+
+type feedEntity struct {
+	ID         string           `json:"id"`
+	TripUpdate *tripUpdate      `json:"trip_update,omitempty"`
+	Vehicle    *vehiclePosition `json:"vehicle,omitempty"`
+}
+
+type tripUpdate struct {
+	Trip           *tripDescriptor   `json:"trip"`
+	StopTimeUpdate []*stopTimeUpdate `json:"stop_time_update"`
+	Timestamp      uint64            `json:"timestamp,omitempty"`
+}
+
+type tripDescriptor struct {
+	TripID    string `json:"trip_id,omitempty"`
+	RouteID   string `json:"route_id,omitempty"`
+	StartDate string `json:"start_date,omitempty"` // YYYYMMDD of service day
+}
+
+type stopTimeUpdate struct {
+	StopSequence         uint32         `json:"stop_sequence,omitempty"`
+	StopID               string         `json:"stop_id,omitempty"`
+	Arrival              *stopTimeEvent `json:"arrival,omitempty"`
+	Departure            *stopTimeEvent `json:"departure,omitempty"`
+	ScheduleRelationship int            `json:"schedule_relationship,omitempty"` // 0 = SCHEDULED
+}
+
+// StopTimeUpdate.ScheduleRelationship
+const (
+	stopScheduled = 0
+	stopSkipped   = 1
+	stopNoData    = 2
+)
+
+type stopTimeEvent struct {
+	Delay *int32 `json:"delay,omitempty"` // Seconds late (negative if early)
+	Time  int64  `json:"time,omitempty"`  // POSIX time
+}
+
+type vehiclePosition struct {
+	Trip                *tripDescriptor `json:"trip,omitempty"`
+	CurrentStopSequence uint32          `json:"current_stop_sequence,omitempty"`
+	StopID              string          `json:"stop_id,omitempty"`
+	CurrentStatus       int             `json:"current_status"`
+	Timestamp           uint64          `json:"timestamp,omitempty"`
+}
+
+// VehiclePosition.CurrentStatus
+const (
+	vehicleIncomingAt  = 0
+	vehicleStoppedAt   = 1
+	vehicleInTransitTo = 2 // Default
+)
+
+//
+// Encoding
+//
+
+// Wire types
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+type protoBuffer struct {
+	buf []byte
+}
+
+func (b *protoBuffer) varint(v uint64) {
+	for v >= 0x80 {
+		b.buf = append(b.buf, byte(v)|0x80)
+		v >>= 7
+	}
+	b.buf = append(b.buf, byte(v))
+}
+
+func (b *protoBuffer) key(field, wire int) {
+	b.varint(uint64(field)<<3 | uint64(wire))
+}
+
+// int32, int64, uint32, uint64 & enums
+func (b *protoBuffer) integer(field int, v int64) {
+	b.key(field, wireVarint)
+	b.varint(uint64(v)) // Negative values use 10 bytes
+}
+
+func (b *protoBuffer) str(field int, s string) {
+	b.key(field, wireBytes)
+	b.varint(uint64(len(s)))
+	b.buf = append(b.buf, s...)
+}
+
+// Embedded message written by encode
+func (b *protoBuffer) message(field int, encode func(*protoBuffer)) {
+	inner := &protoBuffer{}
+	encode(inner)
+
+	b.key(field, wireBytes)
+	b.varint(uint64(len(inner.buf)))
+	b.buf = append(b.buf, inner.buf...)
+}
+
+func (m *feedMessage) marshal() []byte {
+	b := &protoBuffer{}
+	b.message(1, m.Header.encode)
+	for _, entity := range m.Entity {
+		b.message(2, entity.encode)
+	}
+	return b.buf
+}
+
+func (h *feedHeader) encode(b *protoBuffer) {
+	b.str(1, h.GtfsRealtimeVersion)
+	b.integer(2, int64(h.Incrementality))
+	b.integer(3, int64(h.Timestamp))
+}
+
+func (e *feedEntity) encode(b *protoBuffer) {
+	b.str(1, e.ID)
+	if e.TripUpdate != nil {
+		b.message(3, e.TripUpdate.encode)
+	}
+	if e.Vehicle != nil {
+		b.message(4, e.Vehicle.encode)
+	}
+}
+
+func (u *tripUpdate) encode(b *protoBuffer) {
+	b.message(1, u.Trip.encode)
+	for _, update := range u.StopTimeUpdate {
+		b.message(2, update.encode)
+	}
+	if u.Timestamp != 0 {
+		b.integer(4, int64(u.Timestamp))
+	}
+}
+
+func (d *tripDescriptor) encode(b *protoBuffer) {
+	if d.TripID != "" {
+		b.str(1, d.TripID)
+	}
+	if d.StartDate != "" {
+		b.str(3, d.StartDate)
+	}
+	if d.RouteID != "" {
+		b.str(5, d.RouteID)
+	}
+}
+
+func (u *stopTimeUpdate) encode(b *protoBuffer) {
+	if u.StopSequence != 0 {
+		b.integer(1, int64(u.StopSequence))
+	}
+	if u.Arrival != nil {
+		b.message(2, u.Arrival.encode)
+	}
+	if u.Departure != nil {
+		b.message(3, u.Departure.encode)
+	}
+	if u.StopID != "" {
+		b.str(4, u.StopID)
+	}
+	if u.ScheduleRelationship != stopScheduled {
+		b.integer(5, int64(u.ScheduleRelationship))
+	}
+}
+
+func (e *stopTimeEvent) encode(b *protoBuffer) {
+	if e.Delay != nil {
+		b.integer(1, int64(*e.Delay))
+	}
+	if e.Time != 0 {
+		b.integer(2, e.Time)
+	}
+}
+
+func (v *vehiclePosition) encode(b *protoBuffer) {
+	if v.Trip != nil {
+		b.message(1, v.Trip.encode)
+	}
+	if v.CurrentStopSequence != 0 {
+		b.integer(3, int64(v.CurrentStopSequence))
+	}
+	b.integer(4, int64(v.CurrentStatus))
+	if v.Timestamp != 0 {
+		b.integer(5, int64(v.Timestamp))
+	}
+	if v.StopID != "" {
+		b.str(7, v.StopID)
+	}
+}
+
+//
+// Decoding -- unknown fields are skipped
+//
+
+type protoReader struct {
+	buf   []byte
+	field int // Of last key read by next
+	wire  int
+	err   error
+}
+
+func unmarshalFeedMessage(data []byte) (*feedMessage, error) {
+	m := &feedMessage{Header: &feedHeader{}, Entity: []*feedEntity{}}
+
+	r := &protoReader{buf: data}
+	m.decode(r)
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	return m, nil
+}
+
+// Reads key of next field -- false at end of message or after an error
+func (r *protoReader) next() bool {
+	if r.err != nil || len(r.buf) == 0 {
+		return false
+	}
+
+	key := r.varint()
+	r.field, r.wire = int(key>>3), int(key&7)
+	return r.err == nil
+}
+
+func (r *protoReader) varint() uint64 {
+	var v uint64
+	for i := uint(0); i < 64; i += 7 {
+		if len(r.buf) == 0 {
+			break
+		}
+
+		b := r.buf[0]
+		r.buf = r.buf[1:]
+		v |= uint64(b&0x7f) << i
+		if b < 0x80 {
+			return v
+		}
+	}
+
+	r.err = errors.New("gtfs-realtime: invalid varint")
+	return 0
+}
+
+func (r *protoReader) take(n uint64) []byte {
+	if uint64(len(r.buf)) < n {
+		r.err = errors.New("gtfs-realtime: unexpected end of message")
+		r.buf = nil
+		return nil
+	}
+
+	bs := r.buf[:n]
+	r.buf = r.buf[n:]
+	return bs
+}
+
+// Value of varint field
+func (r *protoReader) integer() int64 {
+	if r.wire != wireVarint {
+		r.err = fmt.Errorf("gtfs-realtime: field %d isn't a varint", r.field)
+		return 0
+	}
+	return int64(r.varint())
+}
+
+func (r *protoReader) str() string {
+	if r.wire != wireBytes {
+		r.err = fmt.Errorf("gtfs-realtime: field %d isn't a string", r.field)
+		return ""
+	}
+	return string(r.take(r.varint()))
+}
+
+// Embedded message read by decode
+func (r *protoReader) message(decode func(*protoReader)) {
+	if r.wire != wireBytes {
+		r.err = fmt.Errorf("gtfs-realtime: field %d isn't a message", r.field)
+		return
+	}
+
+	inner := &protoReader{buf: r.take(r.varint())}
+	decode(inner)
+	if inner.err != nil && r.err == nil {
+		r.err = inner.err
+	}
+}
+
+func (r *protoReader) skip() {
+	switch r.wire {
+	case wireVarint:
+		r.varint()
+	case wireFixed64:
+		r.take(8)
+	case wireBytes:
+		r.take(r.varint())
+	case wireFixed32:
+		r.take(4)
+	default:
+		r.err = fmt.Errorf("gtfs-realtime: unsupported wire type %d", r.wire)
+	}
+}
+
+func (m *feedMessage) decode(r *protoReader) {
+	for r.next() {
+		switch r.field {
+		case 1:
+			r.message(m.Header.decode)
+		case 2:
+			entity := &feedEntity{}
+			r.message(entity.decode)
+			m.Entity = append(m.Entity, entity)
+		default:
+			r.skip()
+		}
+	}
+}
+
+func (h *feedHeader) decode(r *protoReader) {
+	for r.next() {
+		switch r.field {
+		case 1:
+			h.GtfsRealtimeVersion = r.str()
+		case 2:
+			h.Incrementality = int(r.integer())
+		case 3:
+			h.Timestamp = uint64(r.integer())
+		default:
+			r.skip()
+		}
+	}
+}
+
+func (e *feedEntity) decode(r *protoReader) {
+	for r.next() {
+		switch r.field {
+		case 1:
+			e.ID = r.str()
+		case 3:
+			e.TripUpdate = &tripUpdate{StopTimeUpdate: []*stopTimeUpdate{}}
+			r.message(e.TripUpdate.decode)
+		case 4:
+			e.Vehicle = &vehiclePosition{CurrentStatus: vehicleInTransitTo}
+			r.message(e.Vehicle.decode)
+		default:
+			r.skip()
+		}
+	}
+}
+
+func (u *tripUpdate) decode(r *protoReader) {
+	for r.next() {
+		switch r.field {
+		case 1:
+			u.Trip = &tripDescriptor{}
+			r.message(u.Trip.decode)
+		case 2:
+			update := &stopTimeUpdate{}
+			r.message(update.decode)
+			u.StopTimeUpdate = append(u.StopTimeUpdate, update)
+		case 4:
+			u.Timestamp = uint64(r.integer())
+		default:
+			r.skip()
+		}
+	}
+}
+
+func (d *tripDescriptor) decode(r *protoReader) {
+	for r.next() {
+		switch r.field {
+		case 1:
+			d.TripID = r.str()
+		case 3:
+			d.StartDate = r.str()
+		case 5:
+			d.RouteID = r.str()
+		default:
+			r.skip()
+		}
+	}
+}
+
+func (u *stopTimeUpdate) decode(r *protoReader) {
+	for r.next() {
+		switch r.field {
+		case 1:
+			u.StopSequence = uint32(r.integer())
+		case 2:
+			u.Arrival = &stopTimeEvent{}
+			r.message(u.Arrival.decode)
+		case 3:
+			u.Departure = &stopTimeEvent{}
+			r.message(u.Departure.decode)
+		case 4:
+			u.StopID = r.str()
+		case 5:
+			u.ScheduleRelationship = int(r.integer())
+		default:
+			r.skip()
+		}
+	}
+}
+
+func (e *stopTimeEvent) decode(r *protoReader) {
+	for r.next() {
+		switch r.field {
+		case 1:
+			delay := int32(r.integer())
+			e.Delay = &delay
+		case 2:
+			e.Time = r.integer()
+		default:
+			r.skip()
+		}
+	}
+}
+
+func (v *vehiclePosition) decode(r *protoReader) {
+	for r.next() {
+		switch r.field {
+		case 1:
+			v.Trip = &tripDescriptor{}
+			r.message(v.Trip.decode)
+		case 3:
+			v.CurrentStopSequence = uint32(r.integer())
+		case 4:
+			v.CurrentStatus = int(r.integer())
+		case 5:
+			v.Timestamp = uint64(r.integer())
+		case 7:
+			v.StopID = r.str()
+		default:
+			r.skip()
+		}
+	}
+}
@@ -0,0 +1,288 @@
+package corvallisbus
+
+import (
+	"errors"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Predicted arrivals from GTFS-Realtime feeds
+//
+// Feeds cover every stop so they are downloaded once for all platforms and
+// kept for realtimeFeedMaxAge. Trip ids and stop ids are resolved with the
+// trips imported from Google Transit -- stop time updates without a stop_id
+// are ignored.
+//
+// TripUpdates are used when a trip has one. Otherwise the delay of the
+// trip's VehiclePosition at its current stop is applied to the stops after it.
+type gtfsRealtimeClient struct {
+	c    Context
+	urls []string
+}
+
+const realtimeFeedMaxAge = 15 * time.Second
+
+// Predicted arrival of a trip at a platform
+type realtimeArrival struct {
+	route    string
+	expected time.Time
+}
+
+type realtimeSnapshot struct {
+	key      string // Dataset & feeds
+	fetched  time.Time
+	arrivals map[int64][]*realtimeArrival // Platform -> arrivals
+}
+
+var globalRealtimeSnapshot *realtimeSnapshot
+var realtimeSnapshotLock sync.Mutex // Feeds are downloaded by one request at a time
+
+func (g *gtfsRealtimeClient) ETA(platform int64) ([]*Prediction, error) {
+	snapshot, err := g.snapshot()
+	if err != nil {
+		return nil, err
+	}
+
+	return realtimePredictions(snapshot.arrivals[platform], time.Now()), nil
+}
+
+// Arrivals after now as minutes until arrival (rounded)
+func realtimePredictions(arrivals []*realtimeArrival, now time.Time) []*Prediction {
+	predictions := []*Prediction{}
+	for _, arr := range arrivals {
+		if arr.expected.Before(now) {
+			continue // Already left
+		}
+
+		predictions = append(predictions, &Prediction{
+			Route:   arr.route,
+			Minutes: int((arr.expected.Sub(now) + time.Minute/2) / time.Minute),
+		})
+	}
+
+	return predictions
+}
+
+func (g *gtfsRealtimeClient) snapshot() (*realtimeSnapshot, error) {
+	realtimeSnapshotLock.Lock()
+	defer realtimeSnapshotLock.Unlock()
+
+	key := g.c.Store().Version() + "|" + strings.Join(g.urls, ",")
+	if s := globalRealtimeSnapshot; s != nil && s.key == key && time.Since(s.fetched) < realtimeFeedMaxAge {
+		return s, nil
+	}
+
+	// A feed that can't be read is left out -- e.g. only VehiclePositions is down
+	feeds := []*feedMessage{}
+	for _, url := range g.urls {
+		feed, err := g.fetch(url)
+		if err != nil {
+			g.c.Warningf("GTFS-Realtime Error (%s): %v", url, err)
+			continue
+		}
+		feeds = append(feeds, feed)
+	}
+	if len(feeds) == 0 {
+		return nil, errors.New("No GTFS-Realtime feed could be read")
+	}
+
+	s, err := newRealtimeSnapshot(g.c, feeds, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	s.key = key
+	globalRealtimeSnapshot = s
+
+	return s, nil
+}
+
+func (g *gtfsRealtimeClient) fetch(url string) (*feedMessage, error) {
+	resp, err := g.c.HTTPClient().Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return nil, &UpstreamError{URL: url, Status: resp.Status}
+	}
+
+	bs, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	return unmarshalFeedMessage(bs)
+}
+
+// Predicted arrivals at every platform from the trips in feeds
+func newRealtimeSnapshot(c Context, feeds []*feedMessage, now time.Time) (*realtimeSnapshot, error) {
+	updates := make(map[string]*tripUpdate)
+	vehicles := make(map[string]*vehiclePosition)
+	tripIDs := []string{}
+	addTrip := func(id string) {
+		_, hasUpdate := updates[id]
+		_, hasVehicle := vehicles[id]
+		if !hasUpdate && !hasVehicle {
+			tripIDs = append(tripIDs, id)
+		}
+	}
+
+	for _, feed := range feeds {
+		for _, entity := range feed.Entity {
+			if u := entity.TripUpdate; u != nil && u.Trip != nil && u.Trip.TripID != "" {
+				addTrip(u.Trip.TripID)
+				updates[u.Trip.TripID] = u
+			}
+			if v := entity.Vehicle; v != nil && v.Trip != nil && v.Trip.TripID != "" {
+				addTrip(v.Trip.TripID)
+				vehicles[v.Trip.TripID] = v
+			}
+		}
+	}
+
+	trips, err := c.Store().Trips(tripIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	snapshot := &realtimeSnapshot{
+		fetched:  now,
+		arrivals: make(map[int64][]*realtimeArrival),
+	}
+
+	for i, trip := range trips {
+		if trip == nil {
+			continue // Not in dataset
+		}
+
+		var times []time.Time
+		if u, ok := updates[tripIDs[i]]; ok {
+			times = tripUpdateTimes(trip, u, tripServiceDayStart(u.Trip, now))
+		} else {
+			v := vehicles[tripIDs[i]]
+			times = vehiclePositionTimes(trip, v, tripServiceDayStart(v.Trip, now), now)
+		}
+
+		for j, st := range trip.StopTimes {
+			if st.Stop == 0 || times[j].IsZero() {
+				continue // Unknown to Connexionz or no prediction
+			}
+
+			arr := &realtimeArrival{route: trip.Route, expected: times[j]}
+			snapshot.arrivals[st.Stop] = append(snapshot.arrivals[st.Stop], arr)
+		}
+	}
+
+	return snapshot, nil
+}
+
+// Start of service day the trip is running on -- today without start_date
+func tripServiceDayStart(trip *tripDescriptor, now time.Time) time.Time {
+	loc := pacificLocation()
+	if date, err := time.ParseInLocation("20060102", trip.StartDate, loc); err == nil {
+		return serviceDayStart(date)
+	}
+
+	return serviceDayStart(now.In(loc))
+}
+
+// Predicted time at each stop of trip -- zero for stops without a prediction
+//
+// A delay is kept for later stops until the next update (same as the
+// GTFS-Realtime specification). Stops before the first update have no
+// prediction.
+func tripUpdateTimes(trip *Trip, u *tripUpdate, start time.Time) []time.Time {
+	times := make([]time.Time, len(trip.StopTimes))
+
+	// Updates are in order travelled -- loops can pass a stop twice
+	updateAt := make(map[int]*stopTimeUpdate)
+	next := 0
+	for _, su := range u.StopTimeUpdate {
+		for j := next; j < len(trip.StopTimes); j++ {
+			if su.StopID != "" && trip.StopTimes[j].StopID == su.StopID {
+				updateAt[j] = su
+				next = j + 1
+				break
+			}
+		}
+	}
+
+	var delay *time.Duration
+	for j, st := range trip.StopTimes {
+		scheduled := start.Add(st.Scheduled)
+
+		su, ok := updateAt[j]
+		if !ok {
+			if delay != nil {
+				times[j] = scheduled.Add(*delay)
+			}
+			continue
+		}
+
+		switch su.ScheduleRelationship {
+		case stopSkipped:
+			continue
+		case stopNoData:
+			delay = nil
+			continue
+		}
+
+		event := su.Arrival
+		if event == nil {
+			event = su.Departure
+		}
+
+		if event != nil && event.Time != 0 {
+			times[j] = time.Unix(event.Time, 0)
+			d := times[j].Sub(scheduled)
+			delay = &d
+		} else if event != nil && event.Delay != nil {
+			d := time.Duration(*event.Delay) * time.Second
+			times[j] = scheduled.Add(d)
+			delay = &d
+		} else if delay != nil {
+			times[j] = scheduled.Add(*delay)
+		}
+	}
+
+	return times
+}
+
+// Predicted time at each stop after the vehicle -- zero for stops without a prediction
+func vehiclePositionTimes(trip *Trip, v *vehiclePosition, start, now time.Time) []time.Time {
+	times := make([]time.Time, len(trip.StopTimes))
+
+	pos := -1
+	for j, st := range trip.StopTimes {
+		if v.StopID != "" && st.StopID == v.StopID {
+			pos = j
+			break
+		}
+	}
+	if pos == -1 {
+		return times // Position along trip isn't known
+	}
+
+	at := now
+	if v.Timestamp != 0 {
+		at = time.Unix(int64(v.Timestamp), 0)
+	}
+
+	delay := at.Sub(start.Add(trip.StopTimes[pos].Scheduled))
+	first := pos
+	if v.CurrentStatus == vehicleStoppedAt {
+		first = pos + 1
+	} else if delay < 0 {
+		delay = 0 // Not at the stop yet -- buses wait for timepoints
+	}
+
+	for j := first; j < len(trip.StopTimes); j++ {
+		times[j] = start.Add(trip.StopTimes[j].Scheduled).Add(delay)
+	}
+
+	return times
+}
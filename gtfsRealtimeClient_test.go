@@ -0,0 +1,192 @@
+package corvallisbus
+
+import (
+	"testing"
+	"time"
+)
+
+// Loop passing B twice -- C is unknown to Connexionz
+func testRealtimeTrip(id string) *Trip {
+	at := func(stopID string, stop int64, minutes int) StopTime {
+		return StopTime{StopID: stopID, Stop: stop, Scheduled: 8*time.Hour + time.Duration(minutes)*time.Minute, IsScheduled: true}
+	}
+
+	return &Trip{ID: id, Route: "1", StopTimes: []StopTime{
+		at("A", 1, 0), at("B", 2, 10), at("C", 0, 20), at("B", 2, 30), at("D", 4, 40),
+	}}
+}
+
+// Minutes after 08:00 of each stop -- -1 for no prediction
+func checkRealtimeTimes(t *testing.T, name string, got []time.Time, start time.Time, want []int) {
+	if len(got) != len(want) {
+		t.Errorf("%s: got %d times, want %d", name, len(got), len(want))
+		return
+	}
+
+	for i, minutes := range want {
+		if minutes == -1 {
+			if !got[i].IsZero() {
+				t.Errorf("%s: stop %d at %v, want no prediction", name, i, got[i])
+			}
+			continue
+		}
+
+		if expected := start.Add(8*time.Hour + time.Duration(minutes)*time.Minute); !got[i].Equal(expected) {
+			t.Errorf("%s: stop %d at %v, want %v", name, i, got[i], expected)
+		}
+	}
+}
+
+func TestTripUpdateTimes(t *testing.T) {
+	start := serviceDayStart(pacificDate(2026, time.October, 16))
+	delay := func(stopID string, seconds int32) *stopTimeUpdate {
+		return &stopTimeUpdate{StopID: stopID, Arrival: &stopTimeEvent{Delay: testDelay(seconds)}}
+	}
+
+	tests := []struct {
+		name    string
+		updates []*stopTimeUpdate
+		want    []int
+	}{
+		{"delay carried forward", []*stopTimeUpdate{delay("B", 120)}, []int{-1, 12, 22, 32, 42}},
+		{"time then delay", []*stopTimeUpdate{
+			{StopID: "A", Arrival: &stopTimeEvent{Time: start.Add(8*time.Hour + time.Minute).Unix()}},
+			delay("C", -60),
+		}, []int{1, 11, 19, 29, 39}},
+		{"departure only", []*stopTimeUpdate{
+			{StopID: "B", Departure: &stopTimeEvent{Delay: testDelay(60)}},
+		}, []int{-1, 11, 21, 31, 41}},
+		{"skipped", []*stopTimeUpdate{
+			delay("A", 60),
+			{StopID: "C", ScheduleRelationship: stopSkipped},
+		}, []int{1, 11, -1, 31, 41}},
+		{"no data", []*stopTimeUpdate{
+			delay("A", 60),
+			{StopID: "B", ScheduleRelationship: stopNoData},
+			delay("D", 0),
+		}, []int{1, -1, -1, -1, 40}},
+		{"loop both passes", []*stopTimeUpdate{delay("B", 60), delay("B", 300)}, []int{-1, 11, 21, 35, 45}},
+		{"loop second pass", []*stopTimeUpdate{delay("C", 0), delay("B", 300)}, []int{-1, -1, 20, 35, 45}},
+		{"unknown stop", []*stopTimeUpdate{delay("X", 60), {Arrival: &stopTimeEvent{Delay: testDelay(60)}}}, []int{-1, -1, -1, -1, -1}},
+	}
+
+	for _, test := range tests {
+		u := &tripUpdate{Trip: &tripDescriptor{TripID: "t"}, StopTimeUpdate: test.updates}
+		checkRealtimeTimes(t, test.name, tripUpdateTimes(testRealtimeTrip("t"), u, start), start, test.want)
+	}
+}
+
+func TestVehiclePositionTimes(t *testing.T) {
+	start := serviceDayStart(pacificDate(2026, time.October, 16))
+	clock := func(minutes int) uint64 {
+		return uint64(start.Add(8*time.Hour + time.Duration(minutes)*time.Minute).Unix())
+	}
+
+	tests := []struct {
+		name    string
+		vehicle *vehiclePosition
+		want    []int
+	}{
+		// Stopped -- the stop is passed, later stops keep the delay
+		{"stopped late", &vehiclePosition{StopID: "B", CurrentStatus: vehicleStoppedAt, Timestamp: clock(13)}, []int{-1, -1, 23, 33, 43}},
+		{"stopped early", &vehiclePosition{StopID: "B", CurrentStatus: vehicleStoppedAt, Timestamp: clock(5)}, []int{-1, -1, 15, 25, 35}},
+
+		// In transit -- arrives at the stop no earlier than scheduled
+		{"in transit late", &vehiclePosition{StopID: "B", CurrentStatus: vehicleInTransitTo, Timestamp: clock(13)}, []int{-1, 13, 23, 33, 43}},
+		{"in transit early", &vehiclePosition{StopID: "B", CurrentStatus: vehicleInTransitTo, Timestamp: clock(5)}, []int{-1, 10, 20, 30, 40}},
+		{"incoming", &vehiclePosition{StopID: "D", CurrentStatus: vehicleIncomingAt, Timestamp: clock(42)}, []int{-1, -1, -1, -1, 42}},
+
+		{"no timestamp", &vehiclePosition{StopID: "A", CurrentStatus: vehicleInTransitTo}, []int{2, 12, 22, 32, 42}},
+		{"unknown stop", &vehiclePosition{StopID: "X", Timestamp: clock(0)}, []int{-1, -1, -1, -1, -1}},
+		{"no stop", &vehiclePosition{Timestamp: clock(0)}, []int{-1, -1, -1, -1, -1}},
+	}
+
+	now := start.Add(8*time.Hour + 2*time.Minute)
+	for _, test := range tests {
+		checkRealtimeTimes(t, test.name, vehiclePositionTimes(testRealtimeTrip("t"), test.vehicle, start, now), start, test.want)
+	}
+}
+
+func TestTripServiceDayStart(t *testing.T) {
+	now := pacificDate(2026, time.October, 16).Add(30 * time.Minute)
+
+	tests := []struct {
+		startDate string
+		want      time.Time
+	}{
+		{"20261015", serviceDayStart(pacificDate(2026, time.October, 15))}, // Running past midnight
+		{"20261016", serviceDayStart(pacificDate(2026, time.October, 16))},
+		{"", serviceDayStart(pacificDate(2026, time.October, 16))},
+		{"2026-10-15", serviceDayStart(pacificDate(2026, time.October, 16))},
+	}
+
+	for _, test := range tests {
+		if got := tripServiceDayStart(&tripDescriptor{StartDate: test.startDate}, now); !got.Equal(test.want) {
+			t.Errorf("start_date %q: got %v, want %v", test.startDate, got, test.want)
+		}
+	}
+}
+
+func TestNewRealtimeSnapshot(t *testing.T) {
+	start := serviceDayStart(pacificDate(2026, time.October, 16))
+	now := start.Add(8*time.Hour + 5*time.Minute)
+
+	feed := &feedMessage{
+		Header: &feedHeader{GtfsRealtimeVersion: gtfsRealtimeVersion, Timestamp: uint64(now.Unix())},
+		Entity: []*feedEntity{
+			{ID: "1", TripUpdate: &tripUpdate{
+				Trip:           &tripDescriptor{TripID: "updated", StartDate: "20261016"},
+				StopTimeUpdate: []*stopTimeUpdate{{StopID: "B", Arrival: &stopTimeEvent{Delay: testDelay(120)}}},
+			}},
+			// TripUpdate of the same trip is used instead
+			{ID: "2", Vehicle: &vehiclePosition{
+				Trip: &tripDescriptor{TripID: "updated"}, StopID: "A", CurrentStatus: vehicleStoppedAt, Timestamp: uint64(now.Unix()),
+			}},
+			{ID: "3", Vehicle: &vehiclePosition{
+				Trip: &tripDescriptor{TripID: "moving"}, StopID: "B", CurrentStatus: vehicleStoppedAt, Timestamp: uint64(now.Add(10 * time.Minute).Unix()),
+			}},
+			{ID: "4", TripUpdate: &tripUpdate{
+				Trip:           &tripDescriptor{TripID: "not-imported"},
+				StopTimeUpdate: []*stopTimeUpdate{{StopID: "B", Arrival: &stopTimeEvent{Delay: testDelay(0)}}},
+			}},
+		},
+	}
+
+	decoded, err := unmarshalFeedMessage(feed.marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := &testContext{t: t, store: &testStore{trips: map[string]*Trip{
+		"updated": testRealtimeTrip("updated"),
+		"moving":  testRealtimeTrip("moving"),
+	}}}
+
+	snapshot, err := newRealtimeSnapshot(c, []*feedMessage{decoded}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Minutes after 08:00 at each platform -- C (platform 0) isn't known to Connexionz
+	want := map[int64][]int{
+		2: {12, 32, 35},
+		4: {42, 45},
+	}
+	if len(snapshot.arrivals) != len(want) {
+		t.Errorf("got arrivals at %d platforms, want %d", len(snapshot.arrivals), len(want))
+	}
+	for platform, minutes := range want {
+		arrivals := snapshot.arrivals[platform]
+		if len(arrivals) != len(minutes) {
+			t.Errorf("platform %d: got %d arrivals, want %d", platform, len(arrivals), len(minutes))
+			continue
+		}
+
+		for i, m := range minutes {
+			expected := start.Add(8*time.Hour + time.Duration(m)*time.Minute)
+			if !arrivals[i].expected.Equal(expected) || arrivals[i].route != "1" {
+				t.Errorf("platform %d: arrival %d is %v (route %s), want %v", platform, i, arrivals[i].expected, arrivals[i].route, expected)
+			}
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package corvallisbus
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func testDelay(seconds int32) *int32 { return &seconds }
+
+// Same message as feedMessageFixture
+func testFeedMessage() *feedMessage {
+	return &feedMessage{
+		Header: &feedHeader{GtfsRealtimeVersion: "2.0", Timestamp: 1000},
+		Entity: []*feedEntity{
+			{
+				ID: "1",
+				TripUpdate: &tripUpdate{
+					Trip: &tripDescriptor{TripID: "t1", StartDate: "20261016"},
+					StopTimeUpdate: []*stopTimeUpdate{
+						{StopSequence: 3, StopID: "B", Arrival: &stopTimeEvent{Delay: testDelay(-60)}},
+					},
+					Timestamp: 1000,
+				},
+			},
+			{
+				ID: "2",
+				Vehicle: &vehiclePosition{
+					Trip:                &tripDescriptor{TripID: "t2"},
+					CurrentStopSequence: 5,
+					StopID:              "C",
+					CurrentStatus:       vehicleStoppedAt,
+					Timestamp:           1000,
+				},
+			},
+		},
+	}
+}
+
+// FeedMessage encoded field by field from gtfs-realtime.proto -- includes
+// fields this server doesn't read (they must be skipped)
+var feedMessageFixture = []byte{
+	0x0a, 0x0a, // header
+	0x0a, 0x03, '2', '.', '0', // gtfs_realtime_version
+	0x10, 0x00, // incrementality FULL_DATASET
+	0x18, 0xe8, 0x07, // timestamp 1000
+
+	0x12, 0x2c, // entity
+	0x0a, 0x01, '1', // id
+	0x1a, 0x27, // trip_update
+	0x0a, 0x0e, // trip
+	0x0a, 0x02, 't', '1', // trip_id
+	0x1a, 0x08, '2', '0', '2', '6', '1', '0', '1', '6', // start_date
+	0x12, 0x12, // stop_time_update
+	0x08, 0x03, // stop_sequence 3
+	0x12, 0x0b, // arrival
+	0x08, 0xc4, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01, // delay -60
+	0x22, 0x01, 'B', // stop_id
+	0x20, 0xe8, 0x07, // timestamp 1000
+
+	0x12, 0x28, // entity
+	0x0a, 0x01, '2', // id
+	0x10, 0x00, // is_deleted (unread)
+	0x22, 0x21, // vehicle
+	0x0a, 0x04, // trip
+	0x0a, 0x02, 't', '2', // trip_id
+	0x12, 0x0a, // position (unread)
+	0x0d, 0x00, 0x40, 0x32, 0x42, // latitude (fixed32)
+	0x15, 0x00, 0x86, 0xf6, 0xc2, // longitude (fixed32)
+	0x18, 0x05, // current_stop_sequence 5
+	0x20, 0x01, // current_status STOPPED_AT
+	0x28, 0xe8, 0x07, // timestamp 1000
+	0x3a, 0x01, 'C', // stop_id
+	0x42, 0x03, // vehicle (unread)
+	0x0a, 0x01, 'v', // id
+}
+
+// JSON for readable failures -- Delay is a pointer
+func checkFeedMessage(t *testing.T, got, want *feedMessage) {
+	if reflect.DeepEqual(got, want) {
+		return
+	}
+
+	gotJSON, _ := json.Marshal(got)
+	wantJSON, _ := json.Marshal(want)
+	t.Errorf("got %s, want %s", gotJSON, wantJSON)
+}
+
+func TestUnmarshalFeedMessageFixture(t *testing.T) {
+	feed, err := unmarshalFeedMessage(feedMessageFixture)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkFeedMessage(t, feed, testFeedMessage())
+}
+
+func TestFeedMessageRoundTrip(t *testing.T) {
+	want := testFeedMessage()
+	want.Entity = append(want.Entity, &feedEntity{
+		ID: "3",
+		TripUpdate: &tripUpdate{
+			Trip: &tripDescriptor{TripID: "t3", RouteID: "R1"},
+			StopTimeUpdate: []*stopTimeUpdate{
+				{StopID: "D", Arrival: &stopTimeEvent{Delay: testDelay(0), Time: 1790000000}},
+				{StopID: "E", Departure: &stopTimeEvent{Time: 1790000060}},
+				{StopID: "F", ScheduleRelationship: stopSkipped},
+			},
+		},
+	})
+
+	feed, err := unmarshalFeedMessage(want.marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkFeedMessage(t, feed, want)
+}
+
+func TestUnmarshalFeedMessageTruncated(t *testing.T) {
+	for n := 1; n < len(feedMessageFixture); n++ {
+		// Cuts ending a top level message are valid -- the rest are inside a field
+		if n == 12 || n == 58 {
+			continue
+		}
+
+		if _, err := unmarshalFeedMessage(feedMessageFixture[:n]); err == nil {
+			t.Errorf("%d of %d bytes: expected error", n, len(feedMessageFixture))
+		}
+	}
+}
@@ -0,0 +1,227 @@
+package corvallisbus
+
+import (
+	"encoding/csv"
+	"math"
+	"time"
+)
+
+/*
+  Times of stops without one in stop_times.txt
+
+  Buses travel at roughly the same speed between timepoints, so the time of a
+  stop is estimated from its distance along the trip:
+    1. shape_dist_traveled of stop_times.txt (all stops of the trip)
+    2. Stop location projected on the trip's shape (shapes.txt)
+    3. Evenly by number of stops (no shape or distances out of order)
+*/
+
+// Mean radius of the earth (meters)
+const earthRadius = 6371000.0
+
+// Stops this close to the shape are on it -- the first pass is used for loops (meters)
+const shapeStopDistance = 50.0
+
+// trip_id -> shape_id from trips.txt (optional column)
+func processTripShapes(r *csv.Reader) map[string]string {
+	tripShapes := make(map[string]string)
+
+	records, _ := r.ReadAll()
+	if len(records) == 0 {
+		return tripShapes
+	}
+
+	columns := columnIndex(records[0])
+	if !hasColumns(columns, "trip_id", "shape_id") {
+		return tripShapes
+	}
+
+	for _, record := range records[1:] {
+		if shapeID := record[columns["shape_id"]]; shapeID != "" {
+			tripShapes[record[columns["trip_id"]]] = shapeID
+		}
+	}
+
+	return tripShapes
+}
+
+// Distance along the trip of each stop (sorted by sequence) -- nil if unknown
+func stopDistances(stops []*SchedInfo, shape []*ShapePoint, matcher *stopMatcher) []float64 {
+	dists := make([]float64, len(stops))
+
+	// Provided by the feed
+	provided := true
+	for i, stop := range stops {
+		if !stop.hasDist {
+			provided = false
+			break
+		}
+		dists[i] = stop.dist
+	}
+	if provided {
+		return dists
+	}
+
+	if len(shape) < 2 {
+		return nil
+	}
+
+	// Projected on shape -- stops are visited in order so the search only moves forward
+	path := make([]LatLng, len(shape))
+	for i, p := range shape {
+		path[i] = p.LatLng
+	}
+	along := pathDistances(path)
+
+	segment := 0
+	for i, stop := range stops {
+		s, ok := matcher.stops[stop.name]
+		if !ok {
+			return nil
+		}
+
+		previous := 0.0
+		if i > 0 {
+			previous = dists[i-1]
+		}
+
+		best, bestSegment, ok := projectOnPath(LatLng{s.lat, s.lng}, path, along, segment, previous)
+		if !ok {
+			return nil // Past the end of shape
+		}
+
+		dists[i] = best
+		segment = bestSegment
+	}
+
+	return dists
+}
+
+// Closest point to p on path not behind segment & previous (distance along path)
+//
+// Returns distance along path and segment of the point -- false if past the end of path.
+func projectOnPath(p LatLng, path []LatLng, along []float64, segment int, previous float64) (float64, int, bool) {
+	var best float64
+	bestDist := math.Inf(1)
+	bestSegment := segment
+	for k := segment; k < len(path)-1; k++ {
+		offset, dist := projectOnSegment(p, path[k], path[k+1])
+		if along[k]+offset < previous {
+			continue // Behind the previous stop
+		}
+
+		if dist < bestDist {
+			best, bestDist, bestSegment = along[k]+offset, dist, k
+		} else if bestDist <= shapeStopDistance && dist > shapeStopDistance {
+			break // Passed the stop -- later passes are a different visit
+		}
+	}
+
+	return best, bestSegment, !math.IsInf(bestDist, 1)
+}
+
+// Point at distance d along path (in segment)
+func pointOnPath(path []LatLng, along []float64, segment int, d float64) LatLng {
+	a, b := path[segment], path[segment+1]
+	length := along[segment+1] - along[segment]
+	if length == 0 {
+		return a
+	}
+
+	t := (d - along[segment]) / length
+	return LatLng{a.Lat + (b.Lat-a.Lat)*t, a.Lng + (b.Lng-a.Lng)*t}
+}
+
+// Fills times of untimed stops between timed stops (see top of file)
+//
+// timed marks stops with a time in stop_times.txt, dists can be nil.
+func interpolateStopTimes(stops []*SchedInfo, timed []bool, dists []float64) {
+	prev := -1
+	for i := range stops {
+		if !timed[i] {
+			continue
+		}
+
+		if prev != -1 && i-prev > 1 {
+			interpolateGap(stops, prev, i, dists)
+		}
+		prev = i
+	}
+}
+
+// Times of stops between timed stops i and j
+func interpolateGap(stops []*SchedInfo, i, j int, dists []float64) {
+	total := stops[j].arrive - stops[i].arrive
+
+	if gapDistancesValid(dists, i, j) {
+		span := dists[j] - dists[i]
+		for k := i + 1; k < j; k++ {
+			fraction := (dists[k] - dists[i]) / span
+			offset := time.Duration(float64(total) * fraction)
+			stops[k].arrive = stops[i].arrive + offset - offset%time.Second
+		}
+		return
+	}
+
+	// Linear fallback -- same time between each stop
+	step := total / time.Duration(j-i)
+	step -= step % time.Second
+	for k := i + 1; k < j; k++ {
+		stops[k].arrive = stops[i].arrive + time.Duration(k-i)*step
+	}
+}
+
+// Distances of the gap are increasing along the trip
+func gapDistancesValid(dists []float64, i, j int) bool {
+	if dists == nil || dists[j] <= dists[i] {
+		return false
+	}
+
+	for k := i + 1; k <= j; k++ {
+		if dists[k] < dists[k-1] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Distance (meters) from the start of path to each point
+func pathDistances(path []LatLng) []float64 {
+	along := make([]float64, len(path))
+	for i := 1; i < len(path); i++ {
+		along[i] = along[i-1] + planarDistance(path[i-1], path[i])
+	}
+	return along
+}
+
+// Distance from a to the closest point to p on segment a-b and from p to it (meters)
+func projectOnSegment(p, a, b LatLng) (float64, float64) {
+	// Flat around a -- segments are short
+	dx, dy := planarOffset(a, b)
+	px, py := planarOffset(a, p)
+
+	length2 := dx*dx + dy*dy
+
+	t := 0.0
+	if length2 > 0 {
+		t = (px*dx + py*dy) / length2
+		t = math.Max(0, math.Min(1, t))
+	}
+
+	cx, cy := t*dx, t*dy
+	return math.Sqrt(length2) * t, math.Hypot(px-cx, py-cy)
+}
+
+func planarDistance(a, b LatLng) float64 {
+	x, y := planarOffset(a, b)
+	return math.Hypot(x, y)
+}
+
+// Position of b relative to a (meters east, meters north)
+func planarOffset(a, b LatLng) (float64, float64) {
+	rad := math.Pi / 180
+	x := (b.Lng - a.Lng) * rad * math.Cos(a.Lat*rad) * earthRadius
+	y := (b.Lat - a.Lat) * rad * earthRadius
+	return x, y
+}
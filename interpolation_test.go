@@ -0,0 +1,133 @@
+package corvallisbus
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+// Point x meters east & y meters north of origin
+func testPoint(x, y float64) LatLng {
+	origin := LatLng{44.5646, -123.2620}
+	rad := math.Pi / 180
+	return LatLng{
+		Lat: origin.Lat + y/(earthRadius*rad),
+		Lng: origin.Lng + x/(earthRadius*rad*math.Cos(origin.Lat*rad)),
+	}
+}
+
+func testShape(points ...LatLng) []*ShapePoint {
+	shape := make([]*ShapePoint, len(points))
+	for i, p := range points {
+		shape[i] = &ShapePoint{LatLng: p, Sequence: i}
+	}
+	return shape
+}
+
+// Stops named by position in stops -- untimed stops have arrive 0
+func testStops(arrive ...time.Duration) ([]*SchedInfo, []bool) {
+	stops := make([]*SchedInfo, len(arrive))
+	timed := make([]bool, len(arrive))
+	for i, a := range arrive {
+		stops[i] = &SchedInfo{arrive: a, id: i, name: string(rune('A' + i))}
+		timed[i] = a != 0
+	}
+	return stops, timed
+}
+
+func testMatcher(points ...LatLng) *stopMatcher {
+	m := &stopMatcher{stops: make(map[string]*gtfsStop)}
+	for i, p := range points {
+		name := string(rune('A' + i))
+		m.stops[name] = &gtfsStop{id: name, name: name, lat: p.Lat, lng: p.Lng}
+	}
+	return m
+}
+
+// Times are truncated to seconds -- projected distances can be a fraction of a meter off
+func checkArrivals(t *testing.T, name string, stops []*SchedInfo, want ...time.Duration) {
+	for i, stop := range stops {
+		if diff := stop.arrive - want[i]; diff < -time.Second || diff > time.Second {
+			t.Errorf("%s: stop %s at %v, want %v", name, stop.name, stop.arrive, want[i])
+		}
+	}
+}
+
+func checkDistances(t *testing.T, name string, dists []float64, want ...float64) {
+	if dists == nil {
+		t.Fatalf("%s: no distances", name)
+	}
+	for i := range want {
+		if math.Abs(dists[i]-want[i]) > 1 {
+			t.Errorf("%s: stop %d at %.1fm, want %.1fm", name, i, dists[i], want[i])
+		}
+	}
+}
+
+const ten = 10 * time.Hour
+
+func TestInterpolateShapeDistTraveled(t *testing.T) {
+	stops, timed := testStops(ten, 0, 0, ten+10*time.Minute)
+	for i, dist := range []float64{0, 100, 400, 1000} {
+		stops[i].dist, stops[i].hasDist = dist, true
+	}
+
+	// Shape & stop locations aren't needed
+	dists := stopDistances(stops, nil, testMatcher())
+	checkDistances(t, "shape_dist_traveled", dists, 0, 100, 400, 1000)
+
+	interpolateStopTimes(stops, timed, dists)
+	checkArrivals(t, "shape_dist_traveled", stops, ten, ten+time.Minute, ten+4*time.Minute, ten+10*time.Minute)
+}
+
+func TestInterpolateProjectedOnShape(t *testing.T) {
+	shape := testShape(testPoint(0, 0), testPoint(1000, 0))
+	matcher := testMatcher(testPoint(0, 0), testPoint(250, 10), testPoint(750, -10), testPoint(1000, 0))
+
+	stops, timed := testStops(ten, 0, 0, ten+8*time.Minute)
+	dists := stopDistances(stops, shape, matcher)
+	checkDistances(t, "straight", dists, 0, 250, 750, 1000)
+
+	interpolateStopTimes(stops, timed, dists)
+	checkArrivals(t, "straight", stops, ten, ten+2*time.Minute, ten+6*time.Minute, ten+8*time.Minute)
+}
+
+func TestInterpolateProjectedOnLoop(t *testing.T) {
+	// East, north, west & south back to the start -- 1400m
+	shape := testShape(testPoint(0, 0), testPoint(500, 0), testPoint(500, 200), testPoint(0, 200), testPoint(0, 0))
+
+	// Last stop is the first one -- must be at the end of the loop, not the start
+	matcher := testMatcher(testPoint(0, 0), testPoint(250, 5), testPoint(250, 195), testPoint(0, 0))
+
+	stops, timed := testStops(ten, 0, 0, ten+14*time.Minute)
+	dists := stopDistances(stops, shape, matcher)
+	checkDistances(t, "loop", dists, 0, 250, 950, 1400)
+
+	interpolateStopTimes(stops, timed, dists)
+	checkArrivals(t, "loop", stops, ten, ten+150*time.Second, ten+570*time.Second, ten+14*time.Minute)
+}
+
+func TestInterpolateNonMonotonicFallsBackToLinear(t *testing.T) {
+	stops, timed := testStops(ten, 0, 0, ten+9*time.Minute)
+	for i, dist := range []float64{0, 600, 300, 1000} {
+		stops[i].dist, stops[i].hasDist = dist, true
+	}
+
+	dists := stopDistances(stops, nil, testMatcher())
+	interpolateStopTimes(stops, timed, dists)
+	checkArrivals(t, "non-monotonic", stops, ten, ten+3*time.Minute, ten+6*time.Minute, ten+9*time.Minute)
+}
+
+func TestInterpolateLinear(t *testing.T) {
+	// No shape_dist_traveled or shape
+	stops, timed := testStops(ten, 0, 0, ten+9*time.Minute, 0, ten+11*time.Minute)
+	matcher := testMatcher(testPoint(0, 0), testPoint(100, 0), testPoint(800, 0), testPoint(900, 0), testPoint(950, 0), testPoint(1000, 0))
+
+	dists := stopDistances(stops, nil, matcher)
+	if dists != nil {
+		t.Fatalf("distances without shape: %v", dists)
+	}
+
+	interpolateStopTimes(stops, timed, dists)
+	checkArrivals(t, "linear", stops, ten, ten+3*time.Minute, ten+6*time.Minute, ten+9*time.Minute, ten+10*time.Minute, ten+11*time.Minute)
+}
@@ -1,14 +1,193 @@
+//go:build appengine
+// +build appengine
+
 package corvallisbus
 
 import (
+	"appengine"
+	"appengine/runtime"
+	"appengine/urlfetch"
 	"gopkg.in/mjibson/v1/appstats"
 	"net/http"
+	"os"
+
+	cts "github.com/cvanderschuere/go-connexionz"
 )
 
 const baseURL = "http://www.corvallistransit.com/"
 
 func init() {
-	http.Handle("/routes", appstats.NewHandler(Routes))
-	http.Handle("/stops", appstats.NewHandler(Stops))
-	http.Handle("/arrivals", appstats.NewHandler(Arrivals))
+	// Set in app.yaml -- Connexionz when empty
+	SetRealtimeFeedURLs(os.Getenv("GTFS_REALTIME_URLS"))
+
+	http.Handle("/routes", appstats.NewHandler(handler(Routes)))
+	http.Handle("/stops", appstats.NewHandler(handler(Stops)))
+	http.Handle("/arrivals", appstats.NewHandler(handler(Arrivals)))
+	http.Handle("/v2/arrivals", appstats.NewHandler(handler(ArrivalsV2)))
+	http.Handle("/trips", appstats.NewHandler(handler(Trips)))
+	http.Handle("/nearby", appstats.NewHandler(handler(Nearby)))
+	http.Handle("/stops/search", appstats.NewHandler(handler(SearchStops)))
+	http.Handle("/stops/", appstats.NewHandler(handler(StopSchedule)))
+	http.Handle("/routes/", appstats.NewHandler(handler(RouteTimetable)))
+	http.Handle("/plan", appstats.NewHandler(handler(Plan)))
+	http.Handle("/gtfs-rt/trip-updates", appstats.NewHandler(handler(TripUpdates)))
+
+	http.HandleFunc("/cron/init", CreateDatabase)
+	http.HandleFunc("/cron/import", ImportLocalFeed)
+	http.Handle("/admin/routeNames", appstats.NewHandler(handler(RouteNames)))
+	http.Handle("/admin/datasets", appstats.NewHandler(handler(Datasets)))
+	http.HandleFunc("/_ah/start", start)
+}
+
+func start(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	c.Infof("Started Instance")
+}
+
+// Imports a new dataset -- queries use the current dataset until it is complete
+func CreateDatabase(w http.ResponseWriter, r *http.Request) {
+
+	context := appengine.NewContext(r)
+
+	// Allows for unlimited time limit
+	runtime.RunInBackground(context, func(c appengine.Context) {
+		if _, err := ImportData(appengineContext{c}); err != nil {
+			c.Errorf("Import Error: %v", err)
+		}
+	})
+}
+
+// Same as CreateDatabase using a Google Transit Feed deployed with the app
+// Paramaters:
+//
+//	feed: path to zip file or unpacked directory (required)
+func ImportLocalFeed(w http.ResponseWriter, r *http.Request) {
+	feedPath := r.FormValue("feed")
+	if feedPath == "" {
+		http.Error(w, "Missing required paramater: feed", 400)
+		return
+	}
+
+	context := appengine.NewContext(r)
+
+	// Allows for unlimited time limit
+	runtime.RunInBackground(context, func(c appengine.Context) {
+		if _, err := ImportFeedPath(appengineContext{c}, feedPath); err != nil {
+			c.Errorf("Import Error (%s): %v", feedPath, err)
+		}
+	})
+}
+
+// Runs handler with a datastore backed Context
+func handler(f func(Context, http.ResponseWriter, *http.Request)) func(appengine.Context, http.ResponseWriter, *http.Request) {
+	return func(c appengine.Context, w http.ResponseWriter, r *http.Request) {
+		f(appengineContext{c}, w, r)
+	}
+}
+
+// Context on App Engine
+type appengineContext struct {
+	appengine.Context
+}
+
+func (c appengineContext) Store() Store {
+	store, err := newDatastoreStore(c.Context)
+	if err != nil {
+		c.Errorf("Active Dataset Error: %v", err)
+	}
+	return store
+}
+
+func (c appengineContext) Connexionz() Connexionz {
+	return ctsClient{cts.New(c.Context, baseURL)}
+}
+
+func (c appengineContext) Realtime() RealtimeProvider {
+	return newRealtimeProvider(c)
+}
+
+func (c appengineContext) HTTPClient() *http.Client {
+	return urlfetch.Client(c.Context)
+}
+
+// Converts go-connexionz types into the ones used by this package
+type ctsClient struct {
+	client *cts.CTS
+}
+
+func (c ctsClient) Patterns() ([]*Pattern, error) {
+	routes, err := c.client.Patterns()
+	if err != nil {
+		return nil, err
+	}
+
+	patterns := []*Pattern{}
+	for _, route := range routes {
+		for _, dest := range route.Destination {
+			for _, pattern := range dest.Patterns {
+				p := &Pattern{
+					Route:       route.Number,
+					Destination: dest.Name,
+					Direction:   pattern.Direction,
+					Polyline:    pattern.Polyline,
+					Platforms:   make([]*Platform, len(pattern.Platforms)),
+				}
+
+				for i, plat := range pattern.Platforms {
+					p.Platforms[i] = convertPlatform(plat)
+				}
+
+				patterns = append(patterns, p)
+			}
+		}
+	}
+
+	return patterns, nil
+}
+
+func (c ctsClient) Platforms() ([]*Platform, error) {
+	plats, err := c.client.Platforms()
+	if err != nil {
+		return nil, err
+	}
+
+	platforms := make([]*Platform, len(plats))
+	for i, plat := range plats {
+		platforms[i] = convertPlatform(plat)
+	}
+
+	return platforms, nil
+}
+
+func (c ctsClient) ETA(platform int64) ([]*Prediction, error) {
+	ctsRoutes, err := c.client.ETA(&cts.Platform{Number: platform})
+	if err != nil {
+		return nil, err
+	}
+
+	predictions := []*Prediction{}
+	for _, ctsRoute := range ctsRoutes {
+		if len(ctsRoute.Destination) > 0 && ctsRoute.Destination[0].Trip != nil {
+			p := &Prediction{
+				Route:   ctsRoute.Number,
+				Minutes: ctsRoute.Destination[0].Trip.ETA,
+			}
+			predictions = append(predictions, p)
+		}
+	}
+
+	return predictions, nil
+}
+
+func convertPlatform(plat *cts.Platform) *Platform {
+	return &Platform{
+		Tag:            plat.Tag,
+		Number:         plat.Number,
+		Name:           plat.Name,
+		Road:           plat.RoadName,
+		Bearing:        plat.Bearing,
+		AdherancePoint: plat.ScheduleAdheranceTimepoint,
+		Lat:            plat.Location.Latitude,
+		Long:           plat.Location.Longitude,
+	}
 }
@@ -0,0 +1,62 @@
+package corvallisbus
+
+import (
+	"strings"
+	"unicode"
+)
+
+// Stop names differ between sources:
+//   Google Transit: "10th & Buchanan", "Monroe & Kings [Shelter]"
+//   Connexionz: "NW 10th St & NW Buchanan Ave"
+// Names are compared by their significant words only.
+
+// Words that don't identify a stop
+var ignoredNameTokens = map[string]bool{
+	"n": true, "s": true, "e": true, "w": true,
+	"nw": true, "ne": true, "sw": true, "se": true,
+	"and": true, "at": true, "the": true,
+	"shelter": true, "not": true, "used": true,
+	"st": true, "street": true, "ave": true, "avenue": true,
+	"blvd": true, "boulevard": true, "rd": true, "road": true,
+	"dr": true, "drive": true, "way": true, "pl": true, "place": true,
+	"ln": true, "lane": true, "hwy": true, "highway": true, "ct": true, "court": true,
+}
+
+// Lowercase significant words of name
+func nameTokens(name string) []string {
+	words := strings.FieldsFunc(strings.ToLower(name), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+
+	tokens := []string{}
+	for _, word := range words {
+		if !ignoredNameTokens[word] {
+			tokens = append(tokens, word)
+		}
+	}
+
+	return tokens
+}
+
+// Fraction of words shared by both names (0-1)
+func nameSimilarity(a, b string) float64 {
+	tokensA, tokensB := nameTokens(a), nameTokens(b)
+	if len(tokensA) == 0 || len(tokensB) == 0 {
+		return 0
+	}
+
+	inB := make(map[string]bool)
+	for _, t := range tokensB {
+		inB[t] = true
+	}
+
+	shared := 0
+	for _, t := range tokensA {
+		if inB[t] {
+			shared++
+		}
+	}
+
+	// Jaccard index
+	return float64(shared) / float64(len(tokensA)+len(tokensB)-shared)
+}
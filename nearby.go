@@ -0,0 +1,138 @@
+package corvallisbus
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Arrivals of each route kept per stop in /nearby
+const nearbyArrivalsPerRoute = 2
+
+/*
+/nearby (endpoint for stops close to a location with their next arrivals)
+
+Default: nothing returned
+Paramaters:
+
+	lat: latitude for search (required); Default: ""
+	lng: longitude for search (required); Default: ""
+	radius: radius in meters to make search; Default: 500
+	limit: maximum number of stops (limited to 20); Default: 10
+
+Response:
+
+	stops: array of stop objects sorted by distance
+	  Arrivals: next arrivals of each route at the stop (see /v2/arrivals)
+*/
+func Nearby(c Context, w http.ResponseWriter, r *http.Request) {
+	// Make sure this is a GET request
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+
+	lat, latErr := strconv.ParseFloat(r.FormValue("lat"), 64)
+	lng, lngErr := strconv.ParseFloat(r.FormValue("lng"), 64)
+	if latErr != nil || lngErr != nil {
+		http.Error(w, "Missing required paramater: lat & lng", 400)
+		return
+	}
+
+	radius := 500
+	if r.FormValue("radius") != "" {
+		val, radErr := strconv.Atoi(r.FormValue("radius"))
+		if radErr != nil {
+			http.Error(w, "Paramater Error[radius]: "+radErr.Error(), 400)
+			return
+		}
+		radius = val
+	}
+
+	limit := 10
+	if r.FormValue("limit") != "" {
+		val, limErr := strconv.Atoi(r.FormValue("limit"))
+		if limErr != nil || val < 1 {
+			http.Error(w, "Paramater Error[limit]: must be a positive number", 400)
+			return
+		} else if val > 20 {
+			http.Error(w, "Maximum of 20 stops exceeded", 400)
+			return
+		}
+		limit = val
+	}
+
+	stops, err := stopsInRadius(c, lat, lng, radius)
+	if err != nil {
+		http.Error(w, "Get Stops Error: "+err.Error(), 500)
+		return
+	}
+	if len(stops) > limit {
+		stops = stops[:limit]
+	}
+
+	routes, err := cachedRoutes(c, c.Store())
+	if err != nil {
+		http.Error(w, "Get Routes Error: "+err.Error(), 500)
+		return
+	}
+
+	routeMap := make(map[string]*Route)
+	for _, route := range routes {
+		routeMap[route.Name] = route
+	}
+
+	// Arrivals of all stops -- loaded concurrently
+	loc, _ := time.LoadLocation("America/Los_Angeles")
+	now := time.Now().In(loc)
+
+	ids := make([]string, len(stops))
+	for i, stop := range stops {
+		ids[i] = strconv.FormatInt(stop.ID, 10)
+	}
+	arrivals := findArrivalsForStops(c, ids, true, &now)
+
+	output := make([]*nearbyStop, len(stops))
+	for i, stop := range stops {
+		directions := stopDirections(c.Store(), routes, stop.ID)
+		all := prepareStopOutputV2(arrivals[ids[i]], routeMap, directions, stop.AdherancePoint, &now)
+		output[i] = &nearbyStop{
+			Stop:     stop,
+			Arrivals: nextArrivalsPerRoute(all, nearbyArrivalsPerRoute),
+		}
+	}
+
+	result := map[string]interface{}{
+		"stops": output,
+	}
+
+	data, errJSON := json.Marshal(result)
+	if errJSON != nil {
+		http.Error(w, errJSON.Error(), 500)
+		return
+	}
+
+	// Output JSON
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprint(w, string(data))
+}
+
+type nearbyStop struct {
+	*Stop
+	Arrivals []*ArrivalV2
+}
+
+// First n arrivals of each route -- arrivals in order of expected arrival
+func nextArrivalsPerRoute(arrivals []*ArrivalV2, n int) []*ArrivalV2 {
+	counts := make(map[string]int)
+	next := []*ArrivalV2{}
+	for _, arr := range arrivals {
+		if counts[arr.Route] < n {
+			counts[arr.Route]++
+			next = append(next, arr)
+		}
+	}
+	return next
+}
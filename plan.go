@@ -0,0 +1,328 @@
+package corvallisbus
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+/plan (endpoint for directions between two places by bus and walking)
+
+Default: nothing returned
+Paramaters:
+
+	from: "lat,lng" of origin (required); Default: ""
+	to: "lat,lng" of destination (required); Default: ""
+	time: time in RFC822Z format; Default: "currentDate"
+	arriveBy: arrive before time instead of leaving after it ["true" or "false"]; Default: "false"
+
+Response:
+
+	itineraries: array of itinerary objects (up to 3) in order of departure
+	  Legs: walking (WALK) and riding a bus (BUS) in order -- times are ISO-8601
+	    Polyline: path of leg (encoded polyline) -- buses follow the shape of their route pattern
+	  Transfers: number of changes between buses
+
+Uses the schedule only -- realtime information is ignored.
+*/
+func Plan(c Context, w http.ResponseWriter, r *http.Request) {
+	// Make sure this is a GET request
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+
+	from, fromErr := parseLatLng(r.FormValue("from"))
+	if fromErr != nil {
+		http.Error(w, "Paramater Error[from]: "+fromErr.Error(), 400)
+		return
+	}
+
+	to, toErr := parseLatLng(r.FormValue("to"))
+	if toErr != nil {
+		http.Error(w, "Paramater Error[to]: "+toErr.Error(), 400)
+		return
+	}
+
+	loc, _ := time.LoadLocation("America/Los_Angeles")
+	planTime := time.Now().In(loc)
+	if paramTime := r.FormValue("time"); len(paramTime) != 0 {
+		inputTime, timeErr := time.Parse(time.RFC822Z, paramTime)
+		if timeErr != nil {
+			http.Error(w, "Paramater Error[time]: "+timeErr.Error(), 400)
+			return
+		}
+		planTime = inputTime.In(loc)
+	}
+
+	arriveBy := strings.ToLower(r.FormValue("arriveBy")) == "true"
+
+	serviceDate := time.Date(planTime.Year(), planTime.Month(), planTime.Day(), 0, 0, 0, 0, loc)
+	tt, err := cachedPlanTimetable(c, serviceDate)
+	if err != nil {
+		http.Error(w, "Plan Error: "+err.Error(), 500)
+		return
+	}
+
+	routes, err := cachedRoutes(c, c.Store())
+	if err != nil {
+		http.Error(w, "Get Routes Error: "+err.Error(), 500)
+		return
+	}
+
+	routeMap := make(map[string]*Route)
+	for _, route := range routes {
+		routeMap[route.Name] = route
+	}
+
+	t := int(sinceServiceDayStart(planTime) / time.Second)
+	journeys := tt.plan(from, to, t, arriveBy)
+
+	itineraries := make([]*planItinerary, len(journeys))
+	for i, steps := range journeys {
+		itineraries[i] = tt.prepareItinerary(steps, from, to, routeMap)
+	}
+	sortItineraries(itineraries)
+
+	result := map[string]interface{}{
+		"itineraries": itineraries,
+	}
+
+	data, errJSON := json.Marshal(result)
+	if errJSON != nil {
+		http.Error(w, errJSON.Error(), 500)
+		return
+	}
+
+	// Output JSON
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprint(w, string(data))
+}
+
+// "lat,lng"
+func parseLatLng(value string) (LatLng, error) {
+	parts := strings.Split(value, ",")
+	if len(parts) != 2 {
+		return LatLng{}, errors.New("expected lat,lng")
+	}
+
+	lat, latErr := strconv.ParseFloat(strings.TrimSpace(parts[0]), 64)
+	lng, lngErr := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+	if latErr != nil || lngErr != nil {
+		return LatLng{}, errors.New("Error in parsing Latitude and Longitude")
+	}
+
+	return LatLng{lat, lng}, nil
+}
+
+type planItinerary struct {
+	Start        time.Time
+	End          time.Time
+	Duration     int     // Minutes
+	Transfers    int     // Changes between buses
+	WalkDistance float64 // Meters
+	Legs         []*planLeg
+}
+
+type planLeg struct {
+	Mode  string // WALK or BUS
+	From  *planPlace
+	To    *planPlace
+	Start time.Time
+	End   time.Time
+
+	Distance float64 `json:",omitempty"` // Walked (meters)
+
+	Route      string  `json:",omitempty"`
+	RouteColor string  `json:",omitempty"` // Hexadecimal
+	Headsign   string  `json:",omitempty"`
+	TripID     string  `json:",omitempty"` // See /trips
+	Stops      []int64 `json:",omitempty"` // Stops passed -- including From & To
+
+	Polyline string
+
+	path []LatLng
+}
+
+// Origin, destination or stop
+type planPlace struct {
+	Stop int64  `json:",omitempty"`
+	Name string `json:",omitempty"`
+	Lat  float64
+	Lng  float64
+}
+
+// Output of steps -- walks start as late as possible before a bus
+func (tt *planTimetable) prepareItinerary(steps []*planStep, from, to LatLng, routeMap map[string]*Route) *planItinerary {
+	place := func(stop int64, point LatLng) *planPlace {
+		if s, ok := tt.index.stops[stop]; ok {
+			return &planPlace{Stop: stop, Name: s.Name, Lat: s.Lat, Lng: s.Long}
+		}
+		return &planPlace{Lat: point.Lat, Lng: point.Lng}
+	}
+	at := func(seconds int) time.Time {
+		return tt.start.Add(time.Duration(seconds) * time.Second)
+	}
+
+	legs := []*planLeg{}
+	for _, step := range steps {
+		if step.board != nil {
+			legs = append(legs, tt.busLeg(step, at, routeMap))
+			continue
+		}
+
+		// Walking -- merged with a walk right before (transfer then walk to destination)
+		walkFrom, walkTo := place(step.from, from), place(step.to, to)
+		duration := time.Duration(walkDuration(step.distance)) * time.Second
+
+		if n := len(legs); n > 0 && legs[n-1].Mode == "WALK" {
+			prev := legs[n-1]
+			prev.To = walkTo
+			prev.Distance += step.distance
+			prev.End = prev.End.Add(duration)
+			prev.path = append(prev.path, LatLng{walkTo.Lat, walkTo.Lng})
+			continue
+		}
+
+		legs = append(legs, &planLeg{
+			Mode:     "WALK",
+			From:     walkFrom,
+			To:       walkTo,
+			Start:    at(step.dep),
+			End:      at(step.dep).Add(duration),
+			Distance: step.distance,
+			path:     []LatLng{{walkFrom.Lat, walkFrom.Lng}, {walkTo.Lat, walkTo.Lng}},
+		})
+	}
+
+	// Walks next to a bus are timed to the bus
+	for i, leg := range legs {
+		leg.Polyline = encodePolyline(leg.path)
+		if leg.Mode != "WALK" {
+			continue
+		}
+
+		duration := leg.End.Sub(leg.Start)
+		if i+1 < len(legs) && legs[i+1].Mode == "BUS" {
+			leg.End = legs[i+1].Start
+			leg.Start = leg.End.Add(-duration)
+		} else if i > 0 && legs[i-1].Mode == "BUS" {
+			leg.Start = legs[i-1].End
+			leg.End = leg.Start.Add(duration)
+		}
+	}
+
+	itinerary := &planItinerary{Legs: legs}
+	if len(legs) > 0 {
+		itinerary.Start = legs[0].Start
+		itinerary.End = legs[len(legs)-1].End
+		itinerary.Duration = int(itinerary.End.Sub(itinerary.Start) / time.Minute)
+	}
+
+	buses := 0
+	for _, leg := range legs {
+		if leg.Mode == "BUS" {
+			buses++
+		} else {
+			itinerary.WalkDistance += leg.Distance
+		}
+	}
+	if buses > 1 {
+		itinerary.Transfers = buses - 1
+	}
+
+	return itinerary
+}
+
+func (tt *planTimetable) busLeg(step *planStep, at func(int) time.Time, routeMap map[string]*Route) *planLeg {
+	trip := tt.trips[step.board.trip]
+
+	leg := &planLeg{
+		Mode:     "BUS",
+		Start:    at(step.board.dep),
+		End:      at(step.alight.arr),
+		Route:    trip.Route,
+		Headsign: trip.Headsign,
+		TripID:   trip.ID,
+		Stops:    []int64{},
+	}
+	if route, ok := routeMap[trip.Route]; ok {
+		leg.RouteColor = route.Color
+	}
+
+	// Stops of trip up to the end of leg -- earlier stops place the leg on loops
+	points := []LatLng{}
+	board := 0
+	for i, st := range trip.StopTimes[:step.alight.toIdx+1] {
+		stop, ok := tt.index.stops[st.Stop]
+		if !ok {
+			continue
+		}
+
+		point := LatLng{stop.Lat, stop.Long}
+		points = append(points, point)
+		if i < step.board.fromIdx {
+			board = len(points)
+			continue
+		}
+
+		leg.Stops = append(leg.Stops, stop.ID)
+		leg.path = append(leg.path, point)
+
+		place := &planPlace{Stop: stop.ID, Name: stop.Name, Lat: stop.Lat, Lng: stop.Long}
+		if leg.From == nil {
+			leg.From = place
+		}
+		leg.To = place
+	}
+
+	if path := legPath(tt.paths[step.board.trip], points, board); path != nil {
+		leg.path = path
+	}
+	return leg
+}
+
+// Part of path from points[board] to the last point -- nil if points aren't on path
+//
+// points are the stops of a trip in order, path is the polyline of its pattern.
+func legPath(path, points []LatLng, board int) []LatLng {
+	if len(path) < 2 || len(points) < 2 {
+		return nil
+	}
+
+	along := pathDistances(path)
+	result := []LatLng{}
+	segment, previous := 0, 0.0
+	for i, p := range points {
+		d, k, ok := projectOnPath(p, path, along, segment, previous)
+		if !ok {
+			return nil
+		}
+
+		if i > board {
+			result = append(result, path[segment+1:k+1]...)
+		}
+		if i >= board {
+			result = append(result, pointOnPath(path, along, k, d))
+		}
+		segment, previous = k, d
+	}
+
+	return result
+}
+
+type byItineraryStart []*planItinerary
+
+func (a byItineraryStart) Len() int           { return len(a) }
+func (a byItineraryStart) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byItineraryStart) Less(i, j int) bool { return a[i].Start.Before(a[j].Start) }
+
+func sortItineraries(itineraries []*planItinerary) {
+	sort.Stable(byItineraryStart(itineraries))
+}
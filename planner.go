@@ -0,0 +1,475 @@
+package corvallisbus
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/kellydunn/golang-geo"
+)
+
+/*
+  Trip planner -- Connection Scan Algorithm (CSA)
+
+  Every trip running on the service day is split into connections (a bus
+  going from one stop to the next) sorted by departure. Scanning them once in
+  order finds the earliest arrival at every stop:
+    - a connection is usable if its trip was boarded before, or the rider
+      is at its stop in time (walked there or arrived by bus + transfer time)
+    - arriving by bus, riders can walk to close stops (transfers)
+
+  Arriving by a time is the same problem backwards in time -- connections
+  are reversed (negative times, from & to swapped) and scanned the same way.
+
+  Connections are built once per dataset version and service day. Trips of
+  the previous service day still running after midnight are included. Bus
+  legs follow the polyline of the trip's route pattern when it has one.
+*/
+
+const (
+	walkSpeed        = 1.25        // Meters per second
+	walkDetour       = 1.3         // Streets aren't straight lines
+	maxWalkDistance  = 800         // To & from stops (meters)
+	transferDistance = 400         // Between stops (meters)
+	minTransferTime  = 60          // Changing buses at the same stop (seconds)
+	planWindow       = 4 * 60 * 60 // Connections after this are never used (seconds)
+	planItineraries  = 3
+)
+
+var globalPlanTimetable *planTimetable // Replaced (not modified) for another dataset or day
+var globalPlanTimetableLock sync.Mutex // Guards globalPlanTimetable -- held while building so it is built once
+
+// Bus going from one stop to the next without stopping
+type connection struct {
+	dep, arr       int   // Seconds from start of service day
+	from, to       int64 // Stops
+	trip           int   // Index in planTimetable.trips
+	fromIdx, toIdx int   // Index in StopTimes of trip
+
+	orig *connection // Connection before reversing time (arriving by a time)
+}
+
+type byDeparture []*connection
+
+func (a byDeparture) Len() int      { return len(a) }
+func (a byDeparture) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a byDeparture) Less(i, j int) bool {
+	if a[i].dep != a[j].dep {
+		return a[i].dep < a[j].dep
+	}
+	return a[i].arr < a[j].arr
+}
+
+// Walk between stops close to each other
+type footpath struct {
+	to       int64
+	duration int // Seconds
+	distance float64
+}
+
+// All connections of a service day
+type planTimetable struct {
+	key   string    // Dataset version & date
+	start time.Time // Start of service day (see serviceDayStart)
+
+	index       *stopIndex
+	trips       []*Trip
+	paths       [][]LatLng    // Polyline of the pattern of each trip -- nil if unknown
+	connections []*connection // Sorted by departure
+	reversed    []*connection // Reversed in time -- sorted by departure
+	footpaths   map[int64][]*footpath
+}
+
+// Timetable of the service day of date -- built on first use
+func cachedPlanTimetable(c Context, date time.Time) (*planTimetable, error) {
+	store := c.Store()
+	key := store.Version() + "|" + date.Format("20060102")
+
+	globalPlanTimetableLock.Lock()
+	defer globalPlanTimetableLock.Unlock()
+
+	tt := globalPlanTimetable
+	if tt != nil && tt.key == key {
+		return tt, nil
+	}
+
+	index, err := cachedStopIndex(c)
+	if err != nil {
+		return nil, err
+	}
+
+	trips, err := store.AllTrips()
+	if err != nil {
+		return nil, err
+	}
+
+	routes, err := cachedRoutes(c, store)
+	if err != nil {
+		return nil, err
+	}
+
+	patterns := make(map[string][]*RoutePattern)
+	for _, route := range routes {
+		if patterns[route.Name], err = cachedRoutePatterns(store, route.Name); err != nil {
+			return nil, err
+		}
+	}
+
+	tt = newPlanTimetable(c, key, date, trips, index, patterns)
+	globalPlanTimetable = tt
+
+	return tt, nil
+}
+
+// patterns are the patterns of each route (by name) -- used for polylines of trips
+func newPlanTimetable(c Context, key string, date time.Time, trips []*Trip, index *stopIndex, patterns map[string][]*RoutePattern) *planTimetable {
+	tt := &planTimetable{
+		key:       key,
+		start:     serviceDayStart(date),
+		index:     index,
+		trips:     []*Trip{},
+		footpaths: make(map[int64][]*footpath),
+	}
+
+	// Previous service day -- shifted to be relative to start of date
+	previous := time.Date(date.Year(), date.Month(), date.Day()-1, 0, 0, 0, 0, date.Location())
+	shift := int(tt.start.Sub(serviceDayStart(previous)) / time.Second)
+
+	// Decoded once per pattern
+	decoded := make(map[*RoutePattern][]LatLng)
+	tripPath := func(trip *Trip) []LatLng {
+		routePatterns := patterns[trip.Route]
+		i := tripPattern(trip, routePatterns)
+		if i == -1 {
+			return nil
+		}
+
+		pattern := routePatterns[i]
+		if _, ok := decoded[pattern]; !ok {
+			decoded[pattern] = decodePolyline(pattern.Polyline)
+		}
+		return decoded[pattern]
+	}
+
+	for _, day := range []struct {
+		date   time.Time
+		offset int
+	}{{date, 0}, {previous, -shift}} {
+		running := servicesRunning(c, day.date)
+		for _, trip := range trips {
+			if running(trip) {
+				tt.addTrip(trip, day.offset, tripPath(trip))
+			}
+		}
+	}
+
+	sort.Sort(byDeparture(tt.connections))
+
+	tt.reversed = make([]*connection, len(tt.connections))
+	for i, conn := range tt.connections {
+		tt.reversed[i] = &connection{
+			dep: -conn.arr, arr: -conn.dep,
+			from: conn.to, to: conn.from,
+			trip: conn.trip, fromIdx: conn.toIdx, toIdx: conn.fromIdx,
+			orig: conn,
+		}
+	}
+	sort.Sort(byDeparture(tt.reversed))
+
+	// Transfers between close stops
+	for id, stop := range index.stops {
+		for _, other := range index.inRadius(stop.Lat, stop.Long, transferDistance) {
+			if other.ID != id {
+				tt.footpaths[id] = append(tt.footpaths[id], &footpath{
+					to:       other.ID,
+					duration: walkDuration(other.Distance),
+					distance: other.Distance,
+				})
+			}
+		}
+	}
+
+	return tt
+}
+
+// Whether trips run on the date of day -- calendar.txt with exceptions
+func servicesRunning(c Context, day time.Time) func(*Trip) bool {
+	added := make(map[string]bool)
+	removed := make(map[string]bool)
+
+	exceptions, err := serviceExceptions(c, &day)
+	if err != nil {
+		c.Errorf("Calendar exception error: %v", err)
+	}
+	for _, exception := range exceptions {
+		switch exception.Type {
+		case ServiceAdded:
+			added[exception.ServiceID] = true
+		case ServiceRemoved:
+			removed[exception.ServiceID] = true
+		}
+	}
+
+	return func(trip *Trip) bool {
+		if added[trip.ServiceID] {
+			return true
+		}
+		return trip.runsOn(day.Weekday()) && !removed[trip.ServiceID]
+	}
+}
+
+// Connections between stops of trip known to Connexionz -- path is the polyline of trip (can be nil)
+func (tt *planTimetable) addTrip(trip *Trip, offset int, path []LatLng) {
+	tripIndex := len(tt.trips)
+	tt.trips = append(tt.trips, trip)
+	tt.paths = append(tt.paths, path)
+
+	prev := -1
+	for i, st := range trip.StopTimes {
+		if _, ok := tt.index.stops[st.Stop]; !ok {
+			continue
+		}
+
+		if prev != -1 {
+			from := trip.StopTimes[prev]
+			conn := &connection{
+				dep:     int(from.Scheduled/time.Second) + offset,
+				arr:     int(st.Scheduled/time.Second) + offset,
+				from:    from.Stop,
+				to:      st.Stop,
+				trip:    tripIndex,
+				fromIdx: prev,
+				toIdx:   i,
+			}
+
+			// Trips before the service day are only used after midnight
+			if conn.dep >= 0 && conn.arr >= conn.dep {
+				tt.connections = append(tt.connections, conn)
+			}
+		}
+		prev = i
+	}
+}
+
+func walkDuration(meters float64) int {
+	return int(meters * walkDetour / walkSpeed)
+}
+
+// Part of a journey found by scan -- in order of scan
+type planStep struct {
+	board, alight *connection // By bus -- nil if walking
+
+	from, to int64 // Stops -- 0 for origin & destination
+	dep, arr int
+	distance float64 // Walked
+}
+
+// Places to start from or end at -- stops with walking distance
+type planAccess map[int64]*footpath
+
+func (tt *planTimetable) access(lat, lng float64) planAccess {
+	access := make(planAccess)
+	for _, stop := range tt.index.inRadius(lat, lng, maxWalkDistance) {
+		access[stop.ID] = &footpath{
+			to:       stop.ID,
+			duration: walkDuration(stop.Distance),
+			distance: stop.Distance,
+		}
+	}
+	return access
+}
+
+// Earliest arrival at destination leaving sources at t -- nil if not reachable
+//
+// direct is walking from source to destination (nil if too far).
+func (tt *planTimetable) scan(conns []*connection, t int, sources, targets planAccess, direct *footpath) []*planStep {
+	arrival := make(map[int64]int)
+	via := make(map[int64]*planStep)
+	boarded := make(map[int]*connection) // Trip -> first connection used
+
+	// Time ready to take a bus from stop
+	ready := func(stop int64) (int, bool) {
+		arr, ok := arrival[stop]
+		if ok && via[stop].board != nil {
+			arr += minTransferTime
+		}
+		return arr, ok
+	}
+
+	for stop, walk := range sources {
+		arrival[stop] = t + walk.duration
+		via[stop] = &planStep{to: stop, dep: t, arr: t + walk.duration, distance: walk.distance}
+	}
+
+	best := math.MaxInt32
+	var bestStop int64
+	if direct != nil {
+		best = t + direct.duration
+	}
+
+	// Earliest arrival at destination through stop
+	reached := func(stop int64) {
+		if walk, ok := targets[stop]; ok && arrival[stop]+walk.duration < best {
+			best = arrival[stop] + walk.duration
+			bestStop = stop
+		}
+	}
+	for stop := range sources {
+		reached(stop)
+	}
+
+	first := sort.Search(len(conns), func(i int) bool { return conns[i].dep >= t })
+	for _, conn := range conns[first:] {
+		if conn.dep >= best || conn.dep > t+planWindow {
+			break // Can't arrive any earlier
+		}
+
+		board, onBoard := boarded[conn.trip]
+		if !onBoard {
+			at, ok := ready(conn.from)
+			if !ok || at > conn.dep {
+				continue
+			}
+			board = conn
+			boarded[conn.trip] = conn
+		}
+
+		if arr, ok := arrival[conn.to]; ok && arr <= conn.arr {
+			continue
+		}
+
+		arrival[conn.to] = conn.arr
+		via[conn.to] = &planStep{board: board, alight: conn, from: board.from, to: conn.to, dep: board.dep, arr: conn.arr}
+		reached(conn.to)
+
+		// Walk to close stops
+		for _, walk := range tt.footpaths[conn.to] {
+			at := conn.arr + walk.duration
+			if arr, ok := arrival[walk.to]; ok && arr <= at {
+				continue
+			}
+
+			arrival[walk.to] = at
+			via[walk.to] = &planStep{from: conn.to, to: walk.to, dep: conn.arr, arr: at, distance: walk.distance}
+			reached(walk.to)
+		}
+	}
+
+	if best == math.MaxInt32 {
+		return nil
+	}
+
+	// Walking only
+	if bestStop == 0 {
+		return []*planStep{{dep: t, arr: best, distance: direct.distance}}
+	}
+
+	// Back from destination to a source
+	walk := targets[bestStop]
+	steps := []*planStep{{from: bestStop, dep: arrival[bestStop], arr: best, distance: walk.distance}}
+	for stop := bestStop; stop != 0 && len(steps) <= len(via); {
+		step := via[stop]
+		steps = append(steps, step)
+		stop = step.from
+	}
+
+	// In order of scan
+	for i, j := 0, len(steps)-1; i < j; i, j = i+1, j-1 {
+		steps[i], steps[j] = steps[j], steps[i]
+	}
+
+	return steps
+}
+
+// Steps of a scan of reversed connections -- in order of time
+func unreverseSteps(steps []*planStep) []*planStep {
+	result := make([]*planStep, len(steps))
+	for i, step := range steps {
+		s := &planStep{
+			from:     step.to,
+			to:       step.from,
+			dep:      -step.arr,
+			arr:      -step.dep,
+			distance: step.distance,
+		}
+		if step.board != nil {
+			s.board, s.alight = step.alight.orig, step.board.orig
+		}
+		result[len(steps)-1-i] = s
+	}
+	return result
+}
+
+// Up to planItineraries ways from origin to destination leaving after t (or arriving before t)
+func (tt *planTimetable) plan(from, to LatLng, t int, arriveBy bool) [][]*planStep {
+	origins, destinations := tt.access(from.Lat, from.Lng), tt.access(to.Lat, to.Lng)
+
+	var direct *footpath
+	dist := geo.NewPoint(from.Lat, from.Lng).GreatCircleDistance(geo.NewPoint(to.Lat, to.Lng)) * 1000.0 // In meters
+	if dist <= 2*maxWalkDistance {
+		direct = &footpath{duration: walkDuration(dist), distance: dist}
+	}
+
+	conns, sources, targets := tt.connections, origins, destinations
+	if arriveBy {
+		conns, sources, targets, t = tt.reversed, destinations, origins, -t
+	}
+
+	results := [][]*planStep{}
+	seen := make(map[string]bool)
+	for attempt := 0; attempt < 2*planItineraries && len(results) < planItineraries; attempt++ {
+		steps := tt.scan(conns, t, sources, targets, direct)
+		if steps == nil {
+			break
+		}
+
+		// Next search must take a later bus than the first one
+		var firstBus *planStep
+		for _, step := range steps {
+			if step.board != nil {
+				firstBus = step
+				break
+			}
+		}
+
+		if arriveBy {
+			steps = unreverseSteps(steps)
+		}
+
+		if key := stepsKey(steps); !seen[key] {
+			seen[key] = true
+			results = append(results, steps)
+		}
+
+		if firstBus == nil {
+			if direct == nil {
+				break
+			}
+
+			// Walking is fastest -- search buses as well
+			direct = nil
+			continue
+		}
+
+		// No walking before the first bus -- it's taken at a source
+		t = firstBus.dep + 1
+		if walk, ok := sources[firstBus.from]; ok {
+			t -= walk.duration
+		}
+	}
+
+	return results
+}
+
+// Trips used -- same key for the same itinerary
+func stepsKey(steps []*planStep) string {
+	key := ""
+	for _, step := range steps {
+		if step.board != nil {
+			key += strconv.Itoa(step.board.trip) + ";"
+		}
+	}
+	return key
+}
@@ -0,0 +1,207 @@
+package corvallisbus
+
+import (
+	"testing"
+	"time"
+)
+
+// Route A: 1 -> 2 -> 3 (polyline bends north between 1 & 2)
+// Route B: 4 -> 5 (no polyline) -- stop 4 is 200m from stop 3
+func testPlanTimetable(t *testing.T, date time.Time) *planTimetable {
+	index := newStopIndex("", []*Stop{
+		{ID: 1, Name: "One", Lat: testPoint(0, 0).Lat, Long: testPoint(0, 0).Lng},
+		{ID: 2, Name: "Two", Lat: testPoint(2000, 0).Lat, Long: testPoint(2000, 0).Lng},
+		{ID: 3, Name: "Three", Lat: testPoint(4000, 0).Lat, Long: testPoint(4000, 0).Lng},
+		{ID: 4, Name: "Four", Lat: testPoint(4200, 0).Lat, Long: testPoint(4200, 0).Lng},
+		{ID: 5, Name: "Five", Lat: testPoint(4200, 3000).Lat, Long: testPoint(4200, 3000).Lng},
+	})
+
+	patterns := map[string][]*RoutePattern{
+		"A": {{Stops: []int64{1, 2, 3}, Polyline: encodePolyline([]LatLng{
+			testPoint(0, 0), testPoint(1000, 500), testPoint(2000, 0), testPoint(4000, 0),
+		})}},
+		"B": {{Stops: []int64{4, 5}}},
+	}
+
+	// Stop, hours & minutes after each other
+	stopTimes := func(times ...int) []StopTime {
+		sts := []StopTime{}
+		for i := 0; i < len(times); i += 3 {
+			scheduled := time.Duration(times[i+1])*time.Hour + time.Duration(times[i+2])*time.Minute
+			sts = append(sts, StopTime{Stop: int64(times[i]), Scheduled: scheduled, IsScheduled: true})
+		}
+		return sts
+	}
+
+	daily := []bool{true, true, true, true, true, true, true}
+	trips := []*Trip{
+		{ID: "A1", Route: "A", Days: daily, StopTimes: stopTimes(1, 8, 0, 2, 8, 10, 3, 8, 20)},
+		{ID: "A2", Route: "A", Days: daily, StopTimes: stopTimes(1, 8, 30, 2, 8, 40, 3, 8, 50)},
+		{ID: "B1", Route: "B", Days: daily, StopTimes: stopTimes(4, 8, 30, 5, 8, 45)},
+		{ID: "B2", Route: "B", Days: daily, StopTimes: stopTimes(4, 9, 0, 5, 9, 15)},
+		{ID: "night", Route: "A", Days: daily, StopTimes: stopTimes(1, 23, 55, 2, 24, 10, 3, 24, 20)},
+	}
+
+	c := &testContext{t: t, store: &testStore{}}
+	return newPlanTimetable(c, "", date, trips, index, patterns)
+}
+
+// Trips of bus legs in order
+func planTrips(tt *planTimetable, steps []*planStep) []string {
+	trips := []string{}
+	for _, step := range steps {
+		if step.board != nil {
+			trips = append(trips, tt.trips[step.board.trip].ID)
+		}
+	}
+	return trips
+}
+
+func checkPlanTrips(t *testing.T, name string, tt *planTimetable, steps []*planStep, want ...string) {
+	got := planTrips(tt, steps)
+	if len(got) != len(want) {
+		t.Errorf("%s: got trips %v, want %v", name, got, want)
+		return
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("%s: got trips %v, want %v", name, got, want)
+			return
+		}
+	}
+}
+
+func clock(hours, minutes int) int {
+	return hours*60*60 + minutes*60
+}
+
+func TestPlanDepartAfter(t *testing.T) {
+	tt := testPlanTimetable(t, pacificDate(2026, time.October, 14))
+	from, to := testPoint(0, -100), testPoint(4200, 3100)
+
+	journeys := tt.plan(from, to, clock(7, 55), false)
+	if len(journeys) != 2 {
+		t.Fatalf("got %d itineraries, want 2", len(journeys))
+	}
+
+	// Transfer walking from stop 3 to stop 4
+	checkPlanTrips(t, "first", tt, journeys[0], "A1", "B1")
+	checkPlanTrips(t, "second", tt, journeys[1], "A2", "B2")
+
+	itinerary := tt.prepareItinerary(journeys[0], from, to, map[string]*Route{})
+	modes := ""
+	for _, leg := range itinerary.Legs {
+		modes += leg.Mode + " "
+	}
+	if modes != "WALK BUS WALK BUS WALK " {
+		t.Fatalf("got legs %s", modes)
+	}
+	if itinerary.Transfers != 1 {
+		t.Errorf("got %d transfers, want 1", itinerary.Transfers)
+	}
+
+	transfer := itinerary.Legs[2]
+	if transfer.From.Stop != 3 || transfer.To.Stop != 4 {
+		t.Errorf("transfer from %d to %d, want 3 to 4", transfer.From.Stop, transfer.To.Stop)
+	}
+
+	// Arrives at 08:45 then walks 100m
+	arrive := tt.start.Add(8*time.Hour + 45*time.Minute + time.Duration(walkDuration(100))*time.Second)
+	if d := itinerary.End.Sub(arrive); d < -time.Second || d > time.Second {
+		t.Errorf("arrives %v, want %v", itinerary.End, arrive)
+	}
+
+	// Bus follows the pattern's polyline -- bus without one goes straight between stops
+	bus := decodePolyline(itinerary.Legs[1].Polyline)
+	if !hasPoint(bus, testPoint(1000, 500)) || !hasPoint(bus, testPoint(0, 0)) || !hasPoint(bus, testPoint(4000, 0)) {
+		t.Errorf("bus A1 path %v doesn't follow the polyline of route A", bus)
+	}
+	if bus := decodePolyline(itinerary.Legs[3].Polyline); len(bus) != 2 {
+		t.Errorf("bus B1 path %v, want straight between 2 stops", bus)
+	}
+}
+
+func TestPlanArriveBy(t *testing.T) {
+	tt := testPlanTimetable(t, pacificDate(2026, time.October, 14))
+	from, to := testPoint(0, -100), testPoint(4200, 3100)
+
+	journeys := tt.plan(from, to, clock(9, 20), true)
+	if len(journeys) != 2 {
+		t.Fatalf("got %d itineraries, want 2", len(journeys))
+	}
+
+	// Latest departure first
+	checkPlanTrips(t, "first", tt, journeys[0], "A2", "B2")
+	checkPlanTrips(t, "second", tt, journeys[1], "A1", "B1")
+
+	for i, steps := range journeys {
+		if last := steps[len(steps)-1]; last.arr > clock(9, 20) {
+			t.Errorf("itinerary %d arrives at %d, after 09:20", i, last.arr)
+		}
+		for j := 1; j < len(steps); j++ {
+			if steps[j].dep < steps[j-1].arr {
+				t.Errorf("itinerary %d: step %d leaves before step %d arrives", i, j, j-1)
+			}
+		}
+	}
+
+	// Too early for B1
+	journeys = tt.plan(from, to, clock(8, 40), true)
+	if len(journeys) != 0 {
+		t.Errorf("arriving by 08:40: got %d itineraries, want 0", len(journeys))
+	}
+}
+
+func TestPlanPastMidnight(t *testing.T) {
+	// Night trip of the day before reaches stop 2 at 00:10
+	tt := testPlanTimetable(t, pacificDate(2026, time.October, 15))
+	from, to := testPoint(2000, -100), testPoint(4000, 100)
+
+	journeys := tt.plan(from, to, clock(0, 0), false)
+	if len(journeys) == 0 {
+		t.Fatal("no itineraries")
+	}
+	checkPlanTrips(t, "night", tt, journeys[0], "night")
+
+	itinerary := tt.prepareItinerary(journeys[0], from, to, map[string]*Route{})
+	var bus *planLeg
+	for _, leg := range itinerary.Legs {
+		if leg.Mode == "BUS" {
+			bus = leg
+		}
+	}
+
+	board := pacificDate(2026, time.October, 15).Add(10 * time.Minute)
+	if !bus.Start.Equal(board) {
+		t.Errorf("boards at %v, want %v", bus.Start, board)
+	}
+
+	// Boarded at stop 2 -- past the bend of the polyline
+	if path := decodePolyline(bus.Polyline); hasPoint(path, testPoint(1000, 500)) || !hasPoint(path, testPoint(2000, 0)) {
+		t.Errorf("bus path %v, want from stop 2", path)
+	}
+}
+
+func TestPlanNoItinerary(t *testing.T) {
+	tt := testPlanTimetable(t, pacificDate(2026, time.October, 14))
+
+	// Far from every stop
+	if journeys := tt.plan(testPoint(0, -100), testPoint(50000, 50000), clock(7, 55), false); len(journeys) != 0 {
+		t.Errorf("far destination: got %d itineraries, want 0", len(journeys))
+	}
+
+	// After the last bus
+	if journeys := tt.plan(testPoint(0, -100), testPoint(4200, 3100), clock(9, 0), false); len(journeys) != 0 {
+		t.Errorf("after last bus: got %d itineraries, want 0", len(journeys))
+	}
+}
+
+// Within a meter of p (polylines are rounded to 1e-5 degrees)
+func hasPoint(path []LatLng, p LatLng) bool {
+	for _, q := range path {
+		if planarDistance(p, q) < 1 {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,92 @@
+package corvallisbus
+
+import (
+	"math"
+)
+
+// Encoded Polyline Algorithm Format
+//   - https://developers.google.com/maps/documentation/utilities/polylinealgorithm
+
+// Latitude/longitude pair
+type LatLng struct {
+	Lat float64
+	Lng float64
+}
+
+func encodePolyline(points []LatLng) string {
+	var buf []byte
+	var prevLat, prevLng int64
+
+	for _, p := range points {
+		lat := int64(math.Floor(p.Lat*1e5 + 0.5))
+		lng := int64(math.Floor(p.Lng*1e5 + 0.5))
+
+		// Each value is encoded as an offset from the previous point
+		buf = appendPolylineValue(buf, lat-prevLat)
+		buf = appendPolylineValue(buf, lng-prevLng)
+
+		prevLat, prevLng = lat, lng
+	}
+
+	return string(buf)
+}
+
+func appendPolylineValue(buf []byte, v int64) []byte {
+	// Left shift -- inverted if negative
+	u := v << 1
+	if v < 0 {
+		u = ^u
+	}
+
+	// 5-bit chunks (smallest first) -- 0x20 set if more chunks follow
+	for u >= 0x20 {
+		buf = append(buf, byte((0x20|(u&0x1f))+63))
+		u >>= 5
+	}
+
+	return append(buf, byte(u+63))
+}
+
+// Points of an encoded polyline -- nil if malformed
+func decodePolyline(s string) []LatLng {
+	var points []LatLng
+	var lat, lng int64
+
+	for i := 0; i < len(s); {
+		var dLat, dLng int64
+		var ok bool
+		if dLat, i, ok = readPolylineValue(s, i); !ok {
+			return nil
+		}
+		if dLng, i, ok = readPolylineValue(s, i); !ok {
+			return nil
+		}
+
+		lat, lng = lat+dLat, lng+dLng
+		points = append(points, LatLng{float64(lat) / 1e5, float64(lng) / 1e5})
+	}
+
+	return points
+}
+
+// Value starting at s[i] and index after it
+func readPolylineValue(s string, i int) (int64, int, bool) {
+	var u int64
+	for shift := uint(0); i < len(s) && shift < 64; shift += 5 {
+		b := int64(s[i]) - 63
+		i++
+		if b < 0 || b > 0x3f {
+			break
+		}
+		u |= (b & 0x1f) << shift
+		if b < 0x20 {
+			// Inverted if negative
+			if u&1 != 0 {
+				return ^(u >> 1), i, true
+			}
+			return u >> 1, i, true
+		}
+	}
+
+	return 0, i, false
+}
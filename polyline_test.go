@@ -0,0 +1,30 @@
+package corvallisbus
+
+import (
+	"math"
+	"testing"
+)
+
+// Example from the format's documentation
+func TestDecodePolyline(t *testing.T) {
+	want := []LatLng{{38.5, -120.2}, {40.7, -120.95}, {43.252, -126.453}}
+
+	encoded := encodePolyline(want)
+	if encoded != "_p~iF~ps|U_ulLnnqC_mqNvxq`@" {
+		t.Errorf("encoded %q", encoded)
+	}
+
+	got := decodePolyline(encoded)
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for i := range want {
+		if math.Abs(got[i].Lat-want[i].Lat) > 1e-9 || math.Abs(got[i].Lng-want[i].Lng) > 1e-9 {
+			t.Errorf("point %d: got %v, want %v", i, got[i], want[i])
+		}
+	}
+
+	if got := decodePolyline("_p~iF~ps|U_ulL"); got != nil {
+		t.Errorf("truncated: got %v, want nil", got)
+	}
+}
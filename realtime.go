@@ -0,0 +1,46 @@
+package corvallisbus
+
+import (
+	"strings"
+)
+
+// RealtimeProvider is the source of predicted arrivals used by /arrivals
+//
+// Connexionz is used unless RealtimeFeedURLs is set -- then predictions come
+// from GTFS-Realtime feeds (see gtfsRealtimeClient.go), e.g. the city's AVL
+// system.
+type RealtimeProvider interface {
+	// Predicted arrivals at a platform (by number)
+	ETA(platform int64) ([]*Prediction, error)
+}
+
+// GTFS-Realtime feeds (TripUpdates and/or VehiclePositions) used instead of Connexionz
+var RealtimeFeedURLs []string
+
+// Sets RealtimeFeedURLs from a comma delimited list -- empty for Connexionz
+func SetRealtimeFeedURLs(urls string) {
+	RealtimeFeedURLs = nil
+	for _, url := range strings.Split(urls, ",") {
+		if url = strings.TrimSpace(url); url != "" {
+			RealtimeFeedURLs = append(RealtimeFeedURLs, url)
+		}
+	}
+}
+
+// Polled ETAs when the poller is running (see etaPoller.go) -- used by Context implementations
+func newRealtimeProvider(c Context) RealtimeProvider {
+	if poller := globalETAPoller; poller != nil {
+		return poller
+	}
+
+	return realtimeSource(c)
+}
+
+// Provider selected by RealtimeFeedURLs
+func realtimeSource(c Context) RealtimeProvider {
+	if len(RealtimeFeedURLs) == 0 {
+		return c.Connexionz()
+	}
+
+	return &gtfsRealtimeClient{c: c, urls: RealtimeFeedURLs}
+}
@@ -0,0 +1,211 @@
+package corvallisbus
+
+import (
+	"encoding/csv"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+/*
+  Mapping between Google Transit route_id and Connexionz route name
+
+  Routes are named differently in both sources (R1 -> 1, BB_N -> NON). Each
+  route in routes.txt is mapped by the first rule that applies:
+    1. Admin provided override (Store().RouteNameOverrides)
+    2. route_short_name or route_id equal to a Connexionz route name
+    3. Connexionz route with the most platforms in common with its trips
+*/
+
+// Fraction of platforms (Jaccard index) in common required to map by stops
+const routeStopOverlap = 0.5
+
+// Single route from routes.txt
+type gtfsRoute struct {
+	id        string
+	shortName string
+	longName  string
+}
+
+// Google Transit route without a Connexionz route -- schedule isn't imported
+type UnmappedRoute struct {
+	ID        string // route_id
+	ShortName string
+	LongName  string
+}
+
+func processRouteNames(r *csv.Reader) []*gtfsRoute {
+	routes := []*gtfsRoute{}
+
+	records, _ := r.ReadAll()
+	if len(records) == 0 {
+		return routes
+	}
+
+	columns := columnIndex(records[0])
+	if !hasColumns(columns, "route_id") {
+		return routes
+	}
+
+	shortCol, hasShort := columns["route_short_name"]
+	longCol, hasLong := columns["route_long_name"]
+	for _, record := range records[1:] {
+		route := &gtfsRoute{id: record[columns["route_id"]]}
+		if hasShort {
+			route.shortName = record[shortCol]
+		}
+		if hasLong {
+			route.longName = record[longCol]
+		}
+
+		routes = append(routes, route)
+	}
+
+	return routes
+}
+
+// Platforms used by the trips of each route (route_id -> platforms)
+func routePlatforms(r *csv.Reader, stopTimes map[string][]*SchedInfo, matcher *stopMatcher) map[string]map[int64]bool {
+	platforms := make(map[string]map[int64]bool)
+
+	records, _ := r.ReadAll()
+	if len(records) == 0 {
+		return platforms
+	}
+
+	columns := columnIndex(records[0])
+	if !hasColumns(columns, "route_id", "trip_id") {
+		return platforms
+	}
+
+	for _, record := range records[1:] {
+		routeID := record[columns["route_id"]]
+		if platforms[routeID] == nil {
+			platforms[routeID] = make(map[int64]bool)
+		}
+
+		for _, stop := range stopTimes[record[columns["trip_id"]]] {
+			// Route isn't known yet -- match without it (not added to report)
+			if num := matcher.match(stop.name, ""); num != 0 {
+				platforms[routeID][num] = true
+			}
+		}
+	}
+
+	return platforms
+}
+
+// Determine Connexionz name of each Google Transit route
+//
+// Returns route_id -> Connexionz name and routes that couldn't be mapped
+func mapRouteNames(routes []*gtfsRoute, platforms map[string]map[int64]bool, matcher *stopMatcher, overrides []*RouteNameOverride) (map[string]string, []*UnmappedRoute) {
+	names := make(map[string]string)
+	unmapped := []*UnmappedRoute{}
+
+	overrideMap := make(map[string]string)
+	for _, o := range overrides {
+		overrideMap[o.GTFS] = o.Connexionz
+	}
+
+	// Normalized Connexionz name -> name
+	normalized := make(map[string]string)
+	for name := range matcher.served {
+		normalized[normalizeRouteName(name)] = name
+	}
+
+	for _, route := range routes {
+		if name, ok := overrideMap[route.id]; ok {
+			if _, known := matcher.served[name]; known {
+				names[route.id] = name
+			} else {
+				// Override of a Connexionz route that no longer exists
+				unmapped = append(unmapped, &UnmappedRoute{
+					ID:        route.id,
+					ShortName: route.shortName,
+					LongName:  route.longName,
+				})
+			}
+			continue
+		}
+
+		if name, ok := normalized[normalizeRouteName(route.shortName)]; ok && route.shortName != "" {
+			names[route.id] = name
+			continue
+		}
+
+		if name, ok := normalized[normalizeRouteName(route.id)]; ok {
+			names[route.id] = name
+			continue
+		}
+
+		if name := closestRoute(platforms[route.id], matcher.served); name != "" {
+			names[route.id] = name
+			continue
+		}
+
+		unmapped = append(unmapped, &UnmappedRoute{
+			ID:        route.id,
+			ShortName: route.shortName,
+			LongName:  route.longName,
+		})
+	}
+
+	sort.Sort(byRouteID(unmapped))
+
+	return names, unmapped
+}
+
+// Connexionz route with the most platforms in common -- "" if none is close enough
+func closestRoute(platforms map[int64]bool, served map[string]map[int64]bool) string {
+	if len(platforms) == 0 {
+		return ""
+	}
+
+	var best string
+	var bestOverlap float64
+	for name, routePlatforms := range served {
+		shared := 0
+		for num := range platforms {
+			if routePlatforms[num] {
+				shared++
+			}
+		}
+
+		// Jaccard index
+		overlap := float64(shared) / float64(len(platforms)+len(routePlatforms)-shared)
+		if overlap > bestOverlap || (overlap == bestOverlap && name < best) {
+			best, bestOverlap = name, overlap
+		}
+	}
+
+	if bestOverlap < routeStopOverlap {
+		return ""
+	}
+
+	return best
+}
+
+// Uppercase letters and digits without "Route" or "R" prefix ("Route 1", "R1" -> "1")
+func normalizeRouteName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return unicode.ToUpper(r)
+		}
+		return -1
+	}, name)
+
+	for _, prefix := range []string{"ROUTE", "R"} {
+		rest := strings.TrimPrefix(name, prefix)
+		if rest != name && rest != "" && unicode.IsDigit(rune(rest[0])) {
+			return rest
+		}
+	}
+
+	return name
+}
+
+type byRouteID []*UnmappedRoute
+
+func (a byRouteID) Len() int           { return len(a) }
+func (a byRouteID) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byRouteID) Less(i, j int) bool { return a[i].ID < a[j].ID }
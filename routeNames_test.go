@@ -0,0 +1,102 @@
+package corvallisbus
+
+import (
+	"testing"
+)
+
+func platformSet(nums ...int64) map[int64]bool {
+	m := make(map[int64]bool)
+	for _, num := range nums {
+		m[num] = true
+	}
+	return m
+}
+
+func TestClosestRoute(t *testing.T) {
+	served := map[string]map[int64]bool{
+		"1": platformSet(1, 2, 3, 4),
+		"2": platformSet(5, 6, 7, 8),
+		"3": platformSet(1, 2, 5, 6),
+	}
+
+	tests := []struct {
+		name      string
+		platforms map[int64]bool
+		want      string
+	}{
+		{"same platforms", platformSet(1, 2, 3, 4), "1"},
+		{"most shared", platformSet(1, 2, 3), "1"},        // 3/4 beats 2/5
+		{"at threshold", platformSet(5, 6, 7), "2"},       // 3/4
+		{"half", platformSet(1, 2), "1"},                  // 2/4 for 1 & 3 -- lower name
+		{"below threshold", platformSet(1, 9, 10), ""},    // 1/6
+		{"extra platforms", platformSet(5, 6, 9, 10), ""}, // 2/6
+		{"no platforms", platformSet(), ""},
+	}
+
+	for _, test := range tests {
+		if got := closestRoute(test.platforms, served); got != test.want {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestNormalizeRouteName(t *testing.T) {
+	tests := []struct {
+		name, want string
+	}{
+		{"R1", "1"},
+		{"Route 1", "1"},
+		{"route-6", "6"},
+		{"BB_N", "BBN"},
+		{"R", "R"},
+		{"RX", "RX"},
+		{"C1", "C1"},
+	}
+
+	for _, test := range tests {
+		if got := normalizeRouteName(test.name); got != test.want {
+			t.Errorf("normalizeRouteName(%q) = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestMapRouteNames(t *testing.T) {
+	matcher := &stopMatcher{served: map[string]map[int64]bool{
+		"1":   platformSet(1, 2, 3),
+		"6":   platformSet(4, 5, 6),
+		"NON": platformSet(7, 8, 9),
+	}}
+
+	routes := []*gtfsRoute{
+		{id: "R1"},
+		{id: "x6", shortName: "Route 6"},
+		{id: "BB_N", shortName: "Beaver Bus North"},
+		{id: "BB_S"},
+		{id: "OLD"},
+		{id: "R6"},
+	}
+	platforms := map[string]map[int64]bool{
+		"BB_N": platformSet(7, 8),
+		"BB_S": platformSet(1, 7),
+	}
+	overrides := []*RouteNameOverride{
+		{GTFS: "OLD", Connexionz: "GONE"}, // Connexionz route no longer exists
+		{GTFS: "R6", Connexionz: "1"},     // Before route_id
+	}
+
+	names, unmapped := mapRouteNames(routes, platforms, matcher, overrides)
+
+	want := map[string]string{"R1": "1", "x6": "6", "BB_N": "NON", "R6": "1"}
+	if len(names) != len(want) {
+		t.Errorf("got %v, want %v", names, want)
+	}
+	for id, name := range want {
+		if names[id] != name {
+			t.Errorf("%s: got %q, want %q", id, names[id], name)
+		}
+	}
+
+	if len(unmapped) != 2 || unmapped[0].ID != "BB_S" || unmapped[1].ID != "OLD" {
+		t.Errorf("got unmapped %v, want BB_S & OLD", unmapped)
+	}
+}
@@ -0,0 +1,300 @@
+package corvallisbus
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var globalRouteTrips map[string][]*Trip // Route name -> trips (with stop times)
+var globalRouteTripsVersion string      // Dataset of globalRouteTrips
+var globalRouteTripsLock sync.Mutex     // Guards globalRouteTrips -- held while loading so trips are loaded once
+
+/*
+/routes/{name}/timetable (endpoint for the printed schedule of a route)
+
+Default: timetable of today
+Paramaters:
+
+	date: date of service in RFC822Z format; Default: "currentDate"
+
+Response:
+
+	route: name of route
+	patterns: array of timetables -- one per pattern (direction, short-turn) with trips on date
+	  Destination, Direction: of pattern
+	  Stops: timepoint stops (columns) in order travelled
+	    -- stops where bus waits until scheduled departure (AdherancePoint)
+	  Trips: array of trips (rows) in order of departure
+	    Times: time of trip at each stop of Stops (ISO-8601) -- null if not stopping
+*/
+func RouteTimetable(c Context, w http.ResponseWriter, r *http.Request) {
+	// Make sure this is a GET request
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+
+	// /routes/{name}/timetable
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(parts) != 3 || parts[2] != "timetable" {
+		http.NotFound(w, r)
+		return
+	}
+	name := parts[1]
+
+	serviceDate, err := parseServiceDate(r)
+	if err != nil {
+		http.Error(w, "Paramater Error[date]: "+err.Error(), 400)
+		return
+	}
+
+	store := c.Store()
+	routes, err := cachedRoutes(c, store)
+	if err != nil {
+		http.Error(w, "Get Routes Error: "+err.Error(), 500)
+		return
+	}
+
+	var route *Route
+	for _, rt := range routes {
+		if rt.Name == name {
+			route = rt
+		}
+	}
+	if route == nil {
+		http.Error(w, "Unknown route: "+name, 404)
+		return
+	}
+
+	patterns, err := cachedRoutePatterns(store, name)
+	if err != nil {
+		http.Error(w, "Get Patterns Error: "+err.Error(), 500)
+		return
+	}
+
+	index, err := cachedStopIndex(c)
+	if err != nil {
+		http.Error(w, "Get Stops Error: "+err.Error(), 500)
+		return
+	}
+
+	trips, err := cachedRouteTrips(c, name)
+	if err != nil {
+		http.Error(w, "Get Trips Error: "+err.Error(), 500)
+		return
+	}
+
+	// Only trips running on date (with holidays & breaks)
+	running := servicesRunning(c, serviceDate)
+	dayTrips := []*Trip{}
+	for _, trip := range trips {
+		if running(trip) {
+			dayTrips = append(dayTrips, trip)
+		}
+	}
+
+	// Datasets without patterns -- longest pattern is kept on route
+	if len(patterns) == 0 {
+		patterns = []*RoutePattern{{Direction: route.Direction, Stops: route.Stops}}
+	}
+
+	result := map[string]interface{}{
+		"route":    name,
+		"patterns": timetableGrids(patterns, index, dayTrips, serviceDayStart(serviceDate)),
+	}
+
+	data, errJSON := json.Marshal(result)
+	if errJSON != nil {
+		http.Error(w, errJSON.Error(), 500)
+		return
+	}
+
+	// Output JSON
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprint(w, string(data))
+}
+
+// Trips of route kept in memory -- all trips are loaded at once per dataset
+func cachedRouteTrips(c Context, route string) ([]*Trip, error) {
+	store := c.Store()
+
+	globalRouteTripsLock.Lock()
+	defer globalRouteTripsLock.Unlock()
+
+	if globalRouteTrips != nil && globalRouteTripsVersion == store.Version() {
+		return globalRouteTrips[route], nil
+	}
+
+	trips, err := store.AllTrips()
+	if err != nil {
+		return nil, err
+	}
+
+	byRoute := make(map[string][]*Trip)
+	for _, trip := range trips {
+		byRoute[trip.Route] = append(byRoute[trip.Route], trip)
+	}
+
+	globalRouteTrips, globalRouteTripsVersion = byRoute, store.Version()
+
+	return byRoute[route], nil
+}
+
+// Timetable of a pattern
+type timetableGrid struct {
+	Destination string           `json:",omitempty"`
+	Direction   string           `json:",omitempty"`
+	Stops       []*Stop          // Columns
+	Trips       []*timetableTrip // Rows
+}
+
+type timetableTrip struct {
+	TripID   string `json:",omitempty"` // See /trips
+	Headsign string `json:",omitempty"`
+	Times    []*time.Time
+
+	first time.Duration // Earliest time -- used for sorting
+}
+
+// Trips grouped by the pattern they follow -- patterns without trips are left out
+func timetableGrids(patterns []*RoutePattern, index *stopIndex, trips []*Trip, start time.Time) []*timetableGrid {
+	grids := make([]*timetableGrid, len(patterns))
+	for i, pattern := range patterns {
+		grids[i] = &timetableGrid{
+			Destination: pattern.Destination,
+			Direction:   pattern.Direction,
+			Stops:       timepointStops(pattern, index),
+			Trips:       []*timetableTrip{},
+		}
+	}
+
+	for _, trip := range trips {
+		i := tripPattern(trip, patterns)
+		if i == -1 {
+			continue
+		}
+
+		if row := timetableRow(trip, grids[i].Stops, start); row != nil {
+			grids[i].Trips = append(grids[i].Trips, row)
+		}
+	}
+
+	output := []*timetableGrid{}
+	for _, grid := range grids {
+		if len(grid.Trips) != 0 {
+			sort.Sort(byFirstTime(grid.Trips))
+			output = append(output, grid)
+		}
+	}
+
+	return output
+}
+
+// Timepoints of pattern in order travelled -- every stop if it has none
+func timepointStops(pattern *RoutePattern, index *stopIndex) []*Stop {
+	timepoints := []*Stop{}
+	all := []*Stop{}
+	for _, id := range pattern.Stops {
+		stop, ok := index.stops[id]
+		if !ok {
+			continue
+		}
+
+		all = append(all, stop)
+		if stop.AdherancePoint {
+			timepoints = append(timepoints, stop)
+		}
+	}
+
+	if len(timepoints) == 0 {
+		return all
+	}
+	return timepoints
+}
+
+// Index of the pattern sharing the most stops in the same order with trip -- the shortest of equals, -1 if none
+func tripPattern(trip *Trip, patterns []*RoutePattern) int {
+	stops := []int64{}
+	for _, st := range trip.StopTimes {
+		if st.Stop != 0 {
+			stops = append(stops, st.Stop)
+		}
+	}
+
+	best, bestShared := -1, 0
+	for i, pattern := range patterns {
+		shared := commonStops(stops, pattern.Stops)
+		if shared > bestShared || (shared == bestShared && shared > 0 && len(pattern.Stops) < len(patterns[best].Stops)) {
+			best, bestShared = i, shared
+		}
+	}
+
+	return best
+}
+
+// Length of the longest common subsequence of a & b -- directions of a route share stops in opposite order
+func commonStops(a, b []int64) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for i := range a {
+		for j := range b {
+			if a[i] == b[j] {
+				cur[j+1] = prev[j] + 1
+			} else {
+				cur[j+1] = maxInt(prev[j+1], cur[j])
+			}
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+// Times of trip at columns -- stops are matched in order so loops fill both visits of a stop
+func timetableRow(trip *Trip, columns []*Stop, start time.Time) *timetableTrip {
+	row := &timetableTrip{
+		TripID:   trip.ID,
+		Headsign: trip.Headsign,
+		Times:    make([]*time.Time, len(columns)),
+	}
+
+	found := false
+	next := 0
+	for col, stop := range columns {
+		for k := next; k < len(trip.StopTimes); k++ {
+			st := trip.StopTimes[k]
+			if st.Stop != stop.ID {
+				continue
+			}
+
+			scheduled := start.Add(st.Scheduled)
+			row.Times[col] = &scheduled
+			if !found || st.Scheduled < row.first {
+				row.first = st.Scheduled
+			}
+			found = true
+			next = k + 1
+			break
+		}
+	}
+
+	if !found {
+		return nil // Doesn't pass any column
+	}
+	return row
+}
+
+type byFirstTime []*timetableTrip
+
+func (a byFirstTime) Len() int      { return len(a) }
+func (a byFirstTime) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a byFirstTime) Less(i, j int) bool {
+	if a[i].first != a[j].first {
+		return a[i].first < a[j].first
+	}
+	return a[i].TripID < a[j].TripID
+}
@@ -0,0 +1,86 @@
+package corvallisbus
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTimetableGrids(t *testing.T) {
+	index := newStopIndex("", []*Stop{
+		{ID: 1, AdherancePoint: true},
+		{ID: 2},
+		{ID: 3, AdherancePoint: true},
+		{ID: 4, AdherancePoint: true},
+	})
+
+	patterns := []*RoutePattern{
+		{Direction: "Outbound", Stops: []int64{1, 2, 3, 4}},
+		{Direction: "Inbound", Stops: []int64{4, 3, 2, 1}},
+		{Direction: "Loop", Stops: []int64{1, 3, 1}},
+	}
+
+	stopTimes := func(stops []int64, minutes ...int) []StopTime {
+		sts := make([]StopTime, len(stops))
+		for i, stop := range stops {
+			sts[i] = StopTime{Stop: stop, Scheduled: 8*time.Hour + time.Duration(minutes[i])*time.Minute}
+		}
+		return sts
+	}
+
+	trips := []*Trip{
+		{ID: "out-late", StopTimes: stopTimes([]int64{1, 2, 3, 4}, 60, 65, 70, 75)},
+		{ID: "out", StopTimes: stopTimes([]int64{1, 2, 3, 4}, 0, 5, 10, 15)},
+		{ID: "in", StopTimes: stopTimes([]int64{4, 3, 2, 1}, 20, 25, 30, 35)},
+		{ID: "loop", StopTimes: stopTimes([]int64{1, 3, 1}, 40, 45, 50)},
+		{ID: "other", StopTimes: stopTimes([]int64{9}, 0)},
+	}
+
+	start := serviceDayStart(pacificDate(2026, time.October, 16))
+	grids := timetableGrids(patterns, index, trips, start)
+	if len(grids) != 3 {
+		t.Fatalf("got %d grids, want 3", len(grids))
+	}
+
+	check := func(grid *timetableGrid, direction string, columns []int64, rows map[string][]int) {
+		if grid.Direction != direction {
+			t.Errorf("got %s, want %s", grid.Direction, direction)
+			return
+		}
+
+		if len(grid.Stops) != len(columns) {
+			t.Fatalf("%s: got %d columns, want %d", direction, len(grid.Stops), len(columns))
+		}
+		for i, stop := range grid.Stops {
+			if stop.ID != columns[i] {
+				t.Errorf("%s: column %d is stop %d, want %d", direction, i, stop.ID, columns[i])
+			}
+		}
+
+		if len(grid.Trips) != len(rows) {
+			t.Fatalf("%s: got %d trips, want %d", direction, len(grid.Trips), len(rows))
+		}
+		for _, row := range grid.Trips {
+			want, ok := rows[row.TripID]
+			if !ok {
+				t.Errorf("%s: unexpected trip %s", direction, row.TripID)
+				continue
+			}
+
+			for col, minutes := range want {
+				at := row.Times[col]
+				if at == nil || at.Sub(start) != 8*time.Hour+time.Duration(minutes)*time.Minute {
+					t.Errorf("%s: trip %s at column %d is %v, want 8h%dm", direction, row.TripID, col, at, minutes)
+				}
+			}
+		}
+	}
+
+	// Last stop of each trip has a time -- no arrival is stored for it
+	check(grids[0], "Outbound", []int64{1, 3, 4}, map[string][]int{"out": {0, 10, 15}, "out-late": {60, 70, 75}})
+	check(grids[1], "Inbound", []int64{4, 3, 1}, map[string][]int{"in": {20, 25, 35}})
+	check(grids[2], "Loop", []int64{1, 3, 1}, map[string][]int{"loop": {40, 45, 50}})
+
+	if grids[0].Trips[0].TripID != "out" {
+		t.Errorf("trips not in order of departure: %s first", grids[0].Trips[0].TripID)
+	}
+}
@@ -1,23 +1,24 @@
 package corvallisbus
 
 import (
-	"appengine"
-	"appengine/datastore"
-	"appengine/memcache"
 	"encoding/json"
 	"fmt"
 	"net/http"
 	"sort"
 	"strings"
-	"time"
+	"sync"
 )
 
 var globalRoutes []*Route
 var globalRouteStopsMap map[string]([]*Stop)
+var globalRoutePatternsMap map[string]([]*RoutePattern)
+var globalRoutesVersion string  // Dataset of globalRoutes, globalRouteStopsMap & globalRoutePatternsMap
+var globalRoutesLock sync.Mutex // Guards all of the above -- handlers run concurrently
 
 func init() {
 	globalRoutes = []*Route{}
 	globalRouteStopsMap = make(map[string]([]*Stop))
+	globalRoutePatternsMap = make(map[string]([]*RoutePattern))
 }
 
 /*
@@ -28,65 +29,37 @@ func init() {
     names: comma delimited list of route names (optional); Default: ""
     stops: include stop information ["true" or "false"]; Default: "false"
     onlyNames: only include route names ["true" or "false"]; Default: "false"
+    patterns: include all patterns (directions, short-turns) ["true" or "false"]; Default: "false"
 
   Response:
     routes: array of route objects
 
 */
-func Routes(c appengine.Context, w http.ResponseWriter, r *http.Request) {
+func Routes(c Context, w http.ResponseWriter, r *http.Request) {
 	// Make sure this is a GET request
 	if r.Method != "GET" {
 		http.Error(w, "Method not allowed", 405)
 		return
 	}
 
-	q := datastore.NewQuery("Route").Order("Name")
-	cacheName := "allRoutes"
+	store := c.Store()
 
-	// Check if should only return only only names
-	if strings.ToLower(r.FormValue("onlyNames")) == "true" {
-		cacheName += "OnlyName"
+	routes, err := cachedRoutes(c, store)
+	if err != nil {
+		http.Error(w, "Get Routes Error: "+err.Error(), 500)
+		return
 	}
 
-	var routes []*Route
-	if len(globalRoutes) != 0 {
-		routes = globalRoutes // Use version from memory
-	} else if _, memError := memcache.Gob.Get(c, cacheName, &routes); memError == memcache.ErrCacheMiss {
-		// Load from datastore
-		_, err := q.GetAll(c, &routes)
-
-		c.Debugf("Result[%d]: ", len(routes), routes)
-
-		if err != nil {
-			http.Error(w, "Get Routes Error: "+err.Error(), 500)
-			return
-		}
-
-		// Clear unneed info
-		if strings.ToLower(r.FormValue("onlyNames")) == "true" {
-			for _, route := range routes {
-				route.AdditionalName = ""
-				route.Description = ""
-				route.URL = ""
-				route.Polyline = ""
-				route.Color = ""
-				route.Direction = ""
-				route.Start = time.Time{}
-				route.End = time.Time{}
+	// Clear unneed info
+	if strings.ToLower(r.FormValue("onlyNames")) == "true" {
+		nameOnly := make([]*Route, len(routes))
+		for i, route := range routes {
+			nameOnly[i] = &Route{
+				Name:  route.Name,
+				Stops: route.Stops,
 			}
 		}
-
-		// Save in memcache
-		item := &memcache.Item{
-			Key:    cacheName,
-			Object: routes,
-		}
-
-		go memcache.Gob.Set(c, item)
-
-		globalRoutes = routes // Save in memory
-	} else if memError == memcache.ErrServerError {
-		http.Error(w, "Get Routes Error: "+memError.Error(), 500)
+		routes = nameOnly
 	}
 
 	// Filter based on "names" param
@@ -111,50 +84,46 @@ func Routes(c appengine.Context, w http.ResponseWriter, r *http.Request) {
 		routes = newRoutes
 	}
 
-	// Load stops
+	// Load stops -- copies so routes in memory are unchanged
 	if strings.ToLower(r.FormValue("stops")) == "true" {
-		for _, route := range routes {
-			// Check memory
-			stopsMem, ok := globalRouteStopsMap[route.Name]
-			if ok {
-				// Use this version
-				route.Path = stopsMem
-				continue
+		withStops := make([]*Route, len(routes))
+		for i, route := range routes {
+			if route == nil {
+				continue // Unknown name
 			}
 
-			path := make([]*Stop, len(route.Stops))
-			for i, _ := range path {
-				path[i] = new(Stop)
+			path, err := cachedRouteStops(store, route)
+			if err != nil {
+				http.Error(w, "Get Path Error: "+err.Error(), 500)
+				return
 			}
 
-			// Check memcache
-			if _, memError := memcache.Gob.Get(c, route.Name+"-Path", &path); memError == memcache.ErrCacheMiss {
-				datastore.GetMulti(c, route.Stops, path)
-
-				// Populate IDs
-				for j, stop := range path {
-					stop.ID = route.Stops[j].IntID()
-				}
-
-				route.Path = path
-
-				// Add to memcache
-				item := &memcache.Item{
-					Key:    route.Name + "-Path",
-					Object: path,
-				}
-				memcache.Gob.Set(c, item)
+			copied := *route
+			copied.Path = path
+			withStops[i] = &copied
+		}
+		routes = withStops
+	}
 
-				// Save in memory
-				globalRouteStopsMap[route.Name] = path
+	// Load patterns -- copies so routes in memory are unchanged
+	if strings.ToLower(r.FormValue("patterns")) == "true" {
+		withPatterns := make([]*Route, len(routes))
+		for i, route := range routes {
+			if route == nil {
+				continue // Unknown name
+			}
 
-			} else if memError == memcache.ErrServerError {
-				http.Error(w, "Get Path Error: "+memError.Error(), 500)
-			} else {
-				// Use memcache value
-				route.Path = path
+			patterns, err := cachedRoutePatterns(store, route.Name)
+			if err != nil {
+				http.Error(w, "Get Patterns Error: "+err.Error(), 500)
+				return
 			}
+
+			copied := *route
+			copied.Patterns = patterns
+			withPatterns[i] = &copied
 		}
+		routes = withPatterns
 	}
 
 	result := map[string]interface{}{
@@ -172,3 +141,81 @@ func Routes(c appengine.Context, w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	fmt.Fprint(w, string(data))
 }
+
+// Routes kept in memory -- loaded from store when empty or a new dataset is activated
+func cachedRoutes(c Context, store Store) ([]*Route, error) {
+	globalRoutesLock.Lock()
+	defer globalRoutesLock.Unlock()
+
+	// Memory is outdated once a new dataset is activated
+	if globalRoutesVersion != store.Version() {
+		globalRoutes = []*Route{}
+		globalRouteStopsMap = make(map[string]([]*Stop))
+		globalRoutePatternsMap = make(map[string]([]*RoutePattern))
+		globalRoutesVersion = store.Version()
+	}
+
+	if len(globalRoutes) != 0 {
+		return globalRoutes, nil // Use version from memory
+	}
+
+	// Load from store
+	routes, err := store.Routes()
+
+	c.Debugf("Result[%d]: %v", len(routes), routes)
+
+	if err != nil {
+		return nil, err
+	}
+
+	globalRoutes = routes // Save in memory
+
+	return routes, nil
+}
+
+// Patterns of route kept in memory -- call cachedRoutes first (clears outdated patterns)
+func cachedRoutePatterns(store Store, name string) ([]*RoutePattern, error) {
+	globalRoutesLock.Lock()
+	defer globalRoutesLock.Unlock()
+
+	if patterns, ok := globalRoutePatternsMap[name]; ok {
+		return patterns, nil // Use version from memory
+	}
+
+	patterns, err := store.RoutePatterns(name)
+	if err != nil {
+		return nil, err
+	}
+
+	globalRoutePatternsMap[name] = patterns // Save in memory
+
+	return patterns, nil
+}
+
+// Stops of route kept in memory -- call cachedRoutes first (clears outdated stops)
+func cachedRouteStops(store Store, route *Route) ([]*Stop, error) {
+	globalRoutesLock.Lock()
+	defer globalRoutesLock.Unlock()
+
+	if path, ok := globalRouteStopsMap[route.Name]; ok {
+		return path, nil // Use version from memory
+	}
+
+	path, err := store.Stops(route.Stops)
+	if err != nil {
+		return nil, err
+	}
+
+	// Populate IDs
+	for j, stop := range path {
+		if stop == nil {
+			stop = new(Stop)
+			path[j] = stop
+		}
+		stop.ID = route.Stops[j]
+	}
+
+	globalRouteStopsMap[route.Name] = path // Save in memory
+
+	return path, nil
+}
@@ -0,0 +1,196 @@
+package corvallisbus
+
+import (
+	"encoding/csv"
+	"sort"
+	"strconv"
+)
+
+/*
+  Route polylines from shapes.txt
+
+  Each trip lists the shape it follows (trips.txt shape_id). The polyline of a
+  route is the shape used by most of its trips. Routes without a shape keep
+  the polyline from Connexionz.
+*/
+
+// Single point of a shape
+type ShapePoint struct {
+	LatLng
+	Sequence int
+	Distance float64 // shape_dist_traveled -- 0 if not provided
+}
+
+type BySequence []*ShapePoint
+
+func (a BySequence) Len() int           { return len(a) }
+func (a BySequence) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a BySequence) Less(i, j int) bool { return a[i].Sequence < a[j].Sequence }
+
+// shape_id -> points sorted by sequence
+func processShapes(r *csv.Reader) map[string][]*ShapePoint {
+	records, _ := r.ReadAll()
+
+	shapes := make(map[string][]*ShapePoint)
+	if len(records) == 0 {
+		return shapes
+	}
+
+	columns := columnIndex(records[0])
+	if !hasColumns(columns, "shape_id", "shape_pt_lat", "shape_pt_lon", "shape_pt_sequence") {
+		return shapes
+	}
+
+	idCol, latCol, lngCol, seqCol := columns["shape_id"], columns["shape_pt_lat"], columns["shape_pt_lon"], columns["shape_pt_sequence"]
+	distCol, hasDist := columns["shape_dist_traveled"]
+
+	for _, record := range records[1:] {
+		lat, latErr := strconv.ParseFloat(record[latCol], 64)
+		lng, lngErr := strconv.ParseFloat(record[lngCol], 64)
+		seq, seqErr := strconv.Atoi(record[seqCol])
+		if latErr != nil || lngErr != nil || seqErr != nil {
+			continue
+		}
+
+		p := &ShapePoint{
+			LatLng:   LatLng{lat, lng},
+			Sequence: seq,
+		}
+
+		if hasDist && record[distCol] != "" {
+			p.Distance, _ = strconv.ParseFloat(record[distCol], 64)
+		}
+
+		shapes[record[idCol]] = append(shapes[record[idCol]], p)
+	}
+
+	for _, points := range shapes {
+		sort.Sort(BySequence(points))
+	}
+
+	return shapes
+}
+
+// Sets polyline of each route to its most used shape
+func updatePolylines(c Context, r *csv.Reader, shapes map[string][]*ShapePoint, routeMap map[string]*Route, routeNameConversion map[string]string, stopTimes map[string][]*SchedInfo, matcher *stopMatcher) {
+	records, _ := r.ReadAll()
+	if len(records) == 0 {
+		return
+	}
+
+	columns := columnIndex(records[0])
+	if !hasColumns(columns, "route_id", "shape_id") {
+		return // No shapes used
+	}
+
+	routeCol, shapeCol := columns["route_id"], columns["shape_id"]
+	tripCol, hasTrip := columns["trip_id"]
+
+	// connexionz route name -> shape_id -> number of trips
+	counts := make(map[string]map[string]int)
+	// connexionz route name -> shape_id -> platforms of trips
+	shapePlatforms := make(map[string]map[string]map[int64]bool)
+	for _, record := range records[1:] {
+		name, ok := routeNameConversion[record[routeCol]]
+		shapeID := record[shapeCol]
+		if !ok || shapeID == "" {
+			continue
+		}
+
+		if counts[name] == nil {
+			counts[name] = make(map[string]int)
+			shapePlatforms[name] = make(map[string]map[int64]bool)
+		}
+		counts[name][shapeID]++
+
+		if shapePlatforms[name][shapeID] == nil {
+			shapePlatforms[name][shapeID] = make(map[int64]bool)
+		}
+		if hasTrip {
+			for _, stop := range stopTimes[record[tripCol]] {
+				if num, ok := matcher.platform(stop.name, name); ok {
+					shapePlatforms[name][shapeID][num] = true
+				}
+			}
+		}
+	}
+
+	for name, shapeCounts := range counts {
+		route, ok := routeMap[name]
+		if !ok {
+			continue
+		}
+
+		// Choose shape with the most trips -- ties go to the longer shape
+		var best string
+		for shapeID, count := range shapeCounts {
+			if best == "" || count > shapeCounts[best] ||
+				(count == shapeCounts[best] && len(shapes[shapeID]) > len(shapes[best])) {
+				best = shapeID
+			}
+		}
+
+		points := shapes[best]
+		if len(points) < 2 {
+			c.Infof("No shape for route %s -- using Connexionz polyline", name)
+			continue
+		}
+
+		route.Polyline = shapePolyline(points)
+
+		updatePatternPolylines(c, name, shapes, shapePlatforms[name])
+	}
+}
+
+// Uses the shape sharing the most platforms with each pattern of route
+func updatePatternPolylines(c Context, name string, shapes map[string][]*ShapePoint, shapePlatforms map[string]map[int64]bool) {
+	patterns, err := c.Store().RoutePatterns(name)
+	if err != nil {
+		c.Errorf("Route Pattern Get Error (%s): %v", name, err)
+		return
+	}
+
+	for _, pattern := range patterns {
+		if best := patternShape(pattern, shapes, shapePlatforms); best != "" {
+			pattern.Polyline = shapePolyline(shapes[best])
+		}
+	}
+
+	if err := c.Store().PutRoutePatterns(name, patterns); err != nil {
+		c.Errorf("Route Pattern Put Error (%s): %v", name, err)
+	}
+}
+
+// shape_id sharing the most platforms with pattern -- "" if none shares any
+func patternShape(pattern *RoutePattern, shapes map[string][]*ShapePoint, shapePlatforms map[string]map[int64]bool) string {
+	var best string
+	var bestOverlap float64
+	for shapeID, platforms := range shapePlatforms {
+		if len(shapes[shapeID]) < 2 {
+			continue
+		}
+
+		shared := 0
+		for _, num := range pattern.Stops {
+			if platforms[num] {
+				shared++
+			}
+		}
+
+		// Jaccard index -- ties go to the lower shape_id
+		overlap := float64(shared) / float64(len(pattern.Stops)+len(platforms)-shared)
+		if overlap > bestOverlap || (overlap == bestOverlap && overlap > 0 && shapeID < best) {
+			best, bestOverlap = shapeID, overlap
+		}
+	}
+
+	return best
+}
+
+func shapePolyline(points []*ShapePoint) string {
+	path := make([]LatLng, len(points))
+	for i, p := range points {
+		path[i] = p.LatLng
+	}
+	return encodePolyline(path)
+}
@@ -0,0 +1,50 @@
+package corvallisbus
+
+import (
+	"testing"
+)
+
+func TestPatternShape(t *testing.T) {
+	line := testShape(testPoint(0, 0), testPoint(1000, 0))
+	shapes := map[string][]*ShapePoint{
+		"out":   line,
+		"in":    line,
+		"short": line,
+		"empty": testShape(testPoint(0, 0)), // Single point -- not a polyline
+	}
+
+	platforms := func(nums ...int64) map[int64]bool {
+		m := make(map[int64]bool)
+		for _, num := range nums {
+			m[num] = true
+		}
+		return m
+	}
+
+	shapePlatforms := map[string]map[int64]bool{
+		"out":   platforms(1, 2, 3, 4),
+		"in":    platforms(4, 5, 6, 1),
+		"short": platforms(1, 2),
+		"empty": platforms(7, 8),
+	}
+
+	tests := []struct {
+		name  string
+		stops []int64
+		want  string
+	}{
+		{"same platforms", []int64{1, 2, 3, 4}, "out"},
+		{"other direction", []int64{4, 5, 6, 1}, "in"},
+		{"short-turn", []int64{1, 2}, "short"},         // 2/2 beats 2/4
+		{"most shared", []int64{1, 2, 3}, "out"},       // 3/4 beats 2/3
+		{"tie to lower shape_id", []int64{1, 4}, "in"}, // 2/4 for in & out, 1/3 for short
+		{"shape without points", []int64{7, 8}, ""},    // Only shares with "empty"
+		{"nothing shared", []int64{9}, ""},
+	}
+
+	for _, test := range tests {
+		if got := patternShape(&RoutePattern{Stops: test.stops}, shapes, shapePlatforms); got != test.want {
+			t.Errorf("%s: got shape %q, want %q", test.name, got, test.want)
+		}
+	}
+}
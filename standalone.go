@@ -0,0 +1,62 @@
+//go:build !appengine
+// +build !appengine
+
+package corvallisbus
+
+import (
+	"log"
+	"net/http"
+)
+
+// Context used outside of App Engine -- see cmd/corvallis-bus
+type localContext struct {
+	store      Store
+	connexionz Connexionz
+	client     *http.Client
+	debug      bool // Log Debugf messages
+}
+
+// Creates a Context backed by store that fetches realtime information from
+// the Connexionz server at connexionzURL
+func NewLocalContext(store Store, connexionzURL string, debug bool) Context {
+	return &localContext{
+		store:      store,
+		connexionz: newConnexionzClient(connexionzURL, http.DefaultClient),
+		client:     http.DefaultClient,
+		debug:      debug,
+	}
+}
+
+func (c *localContext) Debugf(format string, args ...interface{}) {
+	if c.debug {
+		log.Printf("DEBUG: "+format, args...)
+	}
+}
+
+func (c *localContext) Infof(format string, args ...interface{}) {
+	log.Printf("INFO: "+format, args...)
+}
+
+func (c *localContext) Warningf(format string, args ...interface{}) {
+	log.Printf("WARNING: "+format, args...)
+}
+
+func (c *localContext) Errorf(format string, args ...interface{}) {
+	log.Printf("ERROR: "+format, args...)
+}
+
+func (c *localContext) Store() Store {
+	return c.store
+}
+
+func (c *localContext) Connexionz() Connexionz {
+	return c.connexionz
+}
+
+func (c *localContext) Realtime() RealtimeProvider {
+	return newRealtimeProvider(c)
+}
+
+func (c *localContext) HTTPClient() *http.Client {
+	return c.client
+}
@@ -0,0 +1,311 @@
+package corvallisbus
+
+import (
+	"math"
+	"sort"
+	"sync"
+
+	"github.com/kellydunn/golang-geo"
+)
+
+/*
+  In-memory spatial index of stops
+
+  Stops are bucketed in a grid of stopCellSize degrees (like geohash cells)
+  so queries only look at the cells around a location. The index is built
+  once per dataset version from Store().AllStops() and the stops of every
+  route pattern. Stops without coordinates (0,0 from Connexionz) can be
+  found by ID but not by location.
+*/
+
+// Size of a grid cell in degrees (~1.1km north-south, ~0.8km east-west in Corvallis)
+const stopCellSize = 0.01
+
+// Meters per degree of latitude
+const metersPerDegree = 111320.0
+
+var globalStopIndex *stopIndex     // Replaced (not modified) when a new dataset is activated
+var globalStopIndexLock sync.Mutex // Guards globalStopIndex -- held while building so it is built once
+
+type stopCell struct {
+	lat, lng int
+}
+
+type stopIndex struct {
+	version string
+	stops   map[int64]*Stop
+	cells   map[stopCell][]*Stop      // Stops with coordinates
+	routes  map[string]map[int64]bool // Route name -> stops on any pattern
+
+	min, max stopCell // Bounds of occupied cells
+}
+
+func cellOf(lat, lng float64) stopCell {
+	return stopCell{
+		lat: int(math.Floor(lat / stopCellSize)),
+		lng: int(math.Floor(lng / stopCellSize)),
+	}
+}
+
+// Index of the active dataset -- built on first use
+func cachedStopIndex(c Context) (*stopIndex, error) {
+	store := c.Store()
+
+	globalStopIndexLock.Lock()
+	defer globalStopIndexLock.Unlock()
+
+	index := globalStopIndex
+	if index != nil && index.version == store.Version() {
+		return index, nil
+	}
+
+	stops, err := store.AllStops()
+	if err != nil {
+		c.Debugf("Stop QUERY ERROR: %v", err)
+		return nil, err
+	}
+
+	index = newStopIndex(store.Version(), stops)
+
+	routes, err := store.Routes()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, route := range routes {
+		patterns, err := store.RoutePatterns(route.Name)
+		if err != nil {
+			return nil, err
+		}
+
+		index.addRoute(route, patterns)
+	}
+
+	globalStopIndex = index
+
+	return index, nil
+}
+
+func newStopIndex(version string, stops []*Stop) *stopIndex {
+	index := &stopIndex{
+		version: version,
+		stops:   make(map[int64]*Stop),
+		cells:   make(map[stopCell][]*Stop),
+		routes:  make(map[string]map[int64]bool),
+	}
+
+	located := 0
+	for _, stop := range stops {
+		index.stops[stop.ID] = stop
+		if stop.Lat == 0 && stop.Long == 0 {
+			continue // Location unknown -- would stretch the bounds to the Gulf of Guinea
+		}
+
+		cell := cellOf(stop.Lat, stop.Long)
+		index.cells[cell] = append(index.cells[cell], stop)
+
+		located++
+		if located == 1 {
+			index.min, index.max = cell, cell
+			continue
+		}
+		index.min.lat = minInt(index.min.lat, cell.lat)
+		index.min.lng = minInt(index.min.lng, cell.lng)
+		index.max.lat = maxInt(index.max.lat, cell.lat)
+		index.max.lng = maxInt(index.max.lng, cell.lng)
+	}
+
+	return index
+}
+
+func (index *stopIndex) addRoute(route *Route, patterns []*RoutePattern) {
+	served := make(map[int64]bool)
+	for _, id := range route.Stops {
+		served[id] = true
+	}
+	for _, pattern := range patterns {
+		for _, id := range pattern.Stops {
+			served[id] = true
+		}
+	}
+
+	index.routes[route.Name] = served
+}
+
+// Stops within radius (meters) sorted by distance
+func (index *stopIndex) inRadius(lat, lng float64, radiusMeters int) []*Stop {
+	stops := []*Stop{}
+	if len(index.cells) == 0 {
+		return stops
+	}
+
+	// Cells of the square around the circle -- at most the whole earth
+	dLat := math.Min(float64(radiusMeters)/metersPerDegree, 180)
+	dLng := dLat / math.Cos(lat*math.Pi/180)
+	if math.IsNaN(dLng) || dLng > 360 || dLng < 0 {
+		dLng = 360 // Poles
+	}
+
+	low, high := cellOf(lat-dLat, lng-dLng), cellOf(lat+dLat, lng+dLng)
+	if lng-dLng < -180 || lng+dLng > 180 {
+		low.lng, high.lng = cellOf(0, -180).lng, cellOf(0, 180).lng // Crosses the antimeridian
+	}
+
+	current := geo.NewPoint(lat, lng)
+	index.visitCells(low, high, func(stop *Stop) {
+		dist := current.GreatCircleDistance(geo.NewPoint(stop.Lat, stop.Long)) * 1000.0 // In meters
+		if int(dist) <= radiusMeters {
+			stops = append(stops, withDistance(stop, dist))
+		}
+	})
+
+	sort.Sort(ByDistance{stops})
+
+	return stops
+}
+
+// k closest stops sorted by distance
+//
+// Searches rings of cells around location until k stops are closer than any
+// stop outside of the rings can be.
+func (index *stopIndex) nearest(lat, lng float64, k int) []*Stop {
+	if k <= 0 || len(index.cells) == 0 {
+		return []*Stop{}
+	}
+
+	center := cellOf(lat, lng)
+	current := geo.NewPoint(lat, lng)
+
+	// Rings needed to reach every occupied cell
+	maxRing := maxInt(
+		maxInt(center.lat-index.min.lat, index.max.lat-center.lat),
+		maxInt(center.lng-index.min.lng, index.max.lng-center.lng))
+
+	// Narrowest side of a cell (meters)
+	cellMeters := stopCellSize * metersPerDegree * math.Cos(lat*math.Pi/180)
+
+	candidates := []*Stop{}
+	for ring := 0; ring <= maxRing; ring++ {
+		// Far from every stop -- checking all stops is cheaper than more rings
+		if 8*ring > len(index.cells) {
+			candidates = candidates[:0]
+			index.visitCells(index.min, index.max, func(stop *Stop) {
+				dist := current.GreatCircleDistance(geo.NewPoint(stop.Lat, stop.Long)) * 1000.0 // In meters
+				candidates = append(candidates, withDistance(stop, dist))
+			})
+			break
+		}
+
+		for cLat := center.lat - ring; cLat <= center.lat+ring; cLat++ {
+			for cLng := center.lng - ring; cLng <= center.lng+ring; cLng++ {
+				// Only the border -- inner cells were searched before
+				if cLat != center.lat-ring && cLat != center.lat+ring &&
+					cLng != center.lng-ring && cLng != center.lng+ring {
+					continue
+				}
+
+				for _, stop := range index.cells[stopCell{cLat, cLng}] {
+					dist := current.GreatCircleDistance(geo.NewPoint(stop.Lat, stop.Long)) * 1000.0 // In meters
+					candidates = append(candidates, withDistance(stop, dist))
+				}
+			}
+		}
+
+		// Stops outside of the searched rings are at least this far away
+		covered := float64(ring) * cellMeters
+		if len(candidates) >= k {
+			sort.Sort(ByDistance{candidates})
+			if candidates[k-1].Distance <= covered {
+				break
+			}
+		}
+	}
+
+	sort.Sort(ByDistance{candidates})
+	if len(candidates) > k {
+		candidates = candidates[:k]
+	}
+
+	return candidates
+}
+
+// Stops inside of bounding box sorted by ID -- only stops of routes if not empty
+func (index *stopIndex) inBox(minLat, minLng, maxLat, maxLng float64, routes []string) []*Stop {
+	stops := []*Stop{}
+	index.visitCells(cellOf(minLat, minLng), cellOf(maxLat, maxLng), func(stop *Stop) {
+		if stop.Lat < minLat || stop.Lat > maxLat || stop.Long < minLng || stop.Long > maxLng {
+			return
+		}
+
+		if len(routes) == 0 || index.servedBy(stop.ID, routes) {
+			stops = append(stops, stop)
+		}
+	})
+
+	sort.Sort(ByStopID{stops})
+
+	return stops
+}
+
+// Calls visit for each stop in cells from low to high (inclusive)
+//
+// Large areas can cover much more than the area of all stops -- only occupied
+// cells are visited when that's fewer cells.
+func (index *stopIndex) visitCells(low, high stopCell, visit func(*Stop)) {
+	low.lat, low.lng = maxInt(low.lat, index.min.lat), maxInt(low.lng, index.min.lng)
+	high.lat, high.lng = minInt(high.lat, index.max.lat), minInt(high.lng, index.max.lng)
+	if len(index.cells) == 0 || high.lat < low.lat || high.lng < low.lng {
+		return
+	}
+
+	if (high.lat-low.lat+1)*(high.lng-low.lng+1) > len(index.cells) {
+		for cell, stops := range index.cells {
+			if cell.lat < low.lat || cell.lat > high.lat || cell.lng < low.lng || cell.lng > high.lng {
+				continue
+			}
+			for _, stop := range stops {
+				visit(stop)
+			}
+		}
+		return
+	}
+
+	for cLat := low.lat; cLat <= high.lat; cLat++ {
+		for cLng := low.lng; cLng <= high.lng; cLng++ {
+			for _, stop := range index.cells[stopCell{cLat, cLng}] {
+				visit(stop)
+			}
+		}
+	}
+}
+
+// Stop is on any of routes
+func (index *stopIndex) servedBy(id int64, routes []string) bool {
+	for _, name := range routes {
+		if index.routes[name][id] {
+			return true
+		}
+	}
+	return false
+}
+
+// Copy -- indexed stops are shared by requests
+func withDistance(stop *Stop, dist float64) *Stop {
+	s := *stop
+	s.Distance = dist
+	return &s
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
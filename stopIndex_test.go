@@ -0,0 +1,150 @@
+package corvallisbus
+
+import (
+	"testing"
+	"time"
+)
+
+func TestInRadiusLargeRadius(t *testing.T) {
+	index := newStopIndex("", []*Stop{
+		{ID: 1, Lat: 44.5646, Long: -123.2620},
+		{ID: 2, Lat: 44.5900, Long: -123.2800},
+	})
+
+	// Cells are limited to those with stops -- otherwise ~10^12 cells
+	for _, lat := range []float64{44, 89.9999, 90, -90} {
+		start := time.Now()
+		stops := index.inRadius(lat, -123, 100000000)
+		if len(stops) != 2 {
+			t.Errorf("lat %v: got %d stops, want 2", lat, len(stops))
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("lat %v: took %v", lat, elapsed)
+		}
+	}
+
+	if stops := index.inRadius(44.5646, -123.2620, 100); len(stops) != 1 || stops[0].ID != 1 {
+		t.Errorf("100m: got %v, want stop 1", stops)
+	}
+
+	if stops := newStopIndex("", nil).inRadius(44, -123, 1000); len(stops) != 0 {
+		t.Errorf("empty index: got %v", stops)
+	}
+}
+
+func TestInRadiusSparseStops(t *testing.T) {
+	index := newStopIndex("", []*Stop{
+		{ID: 1, Lat: 44.5646, Long: -123.2620},
+		{ID: 2, Lat: -33.8688, Long: 151.2093}, // Bounds cover most of the earth
+		{ID: 3},                                // No coordinates from Connexionz
+	})
+
+	start := time.Now()
+	stops := index.inRadius(44.5646, -123.2620, 100000000)
+	if len(stops) != 2 || stops[0].ID != 1 || stops[1].ID != 2 {
+		t.Errorf("got %v, want stops 1 & 2", stops)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("took %v", elapsed)
+	}
+
+	if stops := index.inRadius(0, 0, 1000); len(stops) != 0 {
+		t.Errorf("at 0,0: got %v, want none", stops)
+	}
+	if index.stops[3] == nil {
+		t.Error("stop without coordinates isn't found by ID")
+	}
+}
+
+func stopIDs(stops []*Stop) []int64 {
+	ids := make([]int64, len(stops))
+	for i, stop := range stops {
+		ids[i] = stop.ID
+	}
+	return ids
+}
+
+func checkStopIDs(t *testing.T, name string, stops []*Stop, want ...int64) {
+	got := stopIDs(stops)
+	if len(got) != len(want) {
+		t.Errorf("%s: got stops %v, want %v", name, got, want)
+		return
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("%s: got stops %v, want %v", name, got, want)
+			return
+		}
+	}
+}
+
+func TestNearest(t *testing.T) {
+	// Query is in the cell of stop 1 (~700m west) -- stop 2 is ~40m east in the next cell
+	index := newStopIndex("", []*Stop{
+		{ID: 1, Lat: 44.5650, Long: -123.2690},
+		{ID: 2, Lat: 44.5650, Long: -123.2595},
+		{ID: 3, Lat: 44.5900, Long: -123.2800},
+		{ID: 4}, // No coordinates
+	})
+
+	tests := []struct {
+		name     string
+		lat, lng float64
+		k        int
+		want     []int64
+	}{
+		{"closer stop in next ring", 44.5650, -123.2601, 1, []int64{2}},
+		{"k of stops", 44.5650, -123.2601, 2, []int64{2, 1}},
+		{"k larger than stops", 44.5650, -123.2601, 10, []int64{2, 1, 3}},
+		{"far from all stops", 10, -123.2601, 2, []int64{2, 1}},
+		{"at 0,0", 0.001, 0.001, 1, []int64{2}},
+		{"k of 0", 44.5650, -123.2601, 0, []int64{}},
+	}
+
+	for _, test := range tests {
+		stops := index.nearest(test.lat, test.lng, test.k)
+		checkStopIDs(t, test.name, stops, test.want...)
+
+		for i := 1; i < len(stops); i++ {
+			if stops[i].Distance < stops[i-1].Distance {
+				t.Errorf("%s: not sorted by distance", test.name)
+			}
+		}
+	}
+
+	if stops := newStopIndex("", nil).nearest(44, -123, 3); len(stops) != 0 {
+		t.Errorf("empty index: got %v", stops)
+	}
+}
+
+func TestInBox(t *testing.T) {
+	index := newStopIndex("", []*Stop{
+		{ID: 3, Lat: 44.5900, Long: -123.2800},
+		{ID: 1, Lat: 44.5646, Long: -123.2620},
+		{ID: 2, Lat: 44.5700, Long: -123.2500},
+		{ID: 4}, // No coordinates
+	})
+	index.addRoute(&Route{Name: "1", Stops: []int64{1}}, []*RoutePattern{{Stops: []int64{1, 2}}})
+	index.addRoute(&Route{Name: "2", Stops: []int64{3}}, nil)
+
+	tests := []struct {
+		name                           string
+		minLat, minLng, maxLat, maxLng float64
+		routes                         []string
+		want                           []int64
+	}{
+		{"all", 44.5, -123.3, 44.6, -123.2, nil, []int64{1, 2, 3}},
+		{"edges included", 44.5646, -123.2620, 44.5700, -123.2500, nil, []int64{1, 2}},
+		{"part", 44.56, -123.27, 44.58, -123.26, nil, []int64{1}},
+		{"route from pattern", 44.5, -123.3, 44.6, -123.2, []string{"1"}, []int64{1, 2}},
+		{"routes", 44.5, -123.3, 44.6, -123.2, []string{"2", "1"}, []int64{1, 2, 3}},
+		{"unknown route", 44.5, -123.3, 44.6, -123.2, []string{"X"}, []int64{}},
+		{"whole earth", -90, -180, 90, 180, nil, []int64{1, 2, 3}},
+		{"empty area", 10, 10, 11, 11, nil, []int64{}},
+		{"inverted", 44.6, -123.2, 44.5, -123.3, nil, []int64{}},
+	}
+
+	for _, test := range tests {
+		checkStopIDs(t, test.name, index.inBox(test.minLat, test.minLng, test.maxLat, test.maxLng, test.routes), test.want...)
+	}
+}
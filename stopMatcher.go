@@ -0,0 +1,211 @@
+package corvallisbus
+
+import (
+	"encoding/csv"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/kellydunn/golang-geo"
+)
+
+/*
+  Mapping between Google Transit stop_id and Connexionz platform number
+
+  stops.txt lists the platform number as stop_code. Stops without a usable
+  stop_code are matched to the closest Connexionz platform with a similar
+  name. Stops shared by several routes in Google Transit (Downtown Transit
+  Center) have a platform per route in Connexionz -- the platform served by
+  the route is used.
+*/
+
+// Platforms farther than this are never matched (meters)
+const stopMatchRadius = 50.0
+
+// Single stop from stops.txt
+type gtfsStop struct {
+	id   string
+	code string
+	name string
+	lat  float64
+	lng  float64
+}
+
+// Stop that couldn't be mapped to a Connexionz platform
+type UnmatchedStop struct {
+	ID     string // stop_id
+	Code   string // stop_code
+	Name   string
+	Lat    float64
+	Lng    float64
+	Routes []string // Connexionz route names using this stop
+}
+
+type stopMatcher struct {
+	stops     map[string]*gtfsStop
+	platforms map[int64]*Platform
+	served    map[string]map[int64]bool // Connexionz route name -> platforms on any pattern
+
+	matches   map[string]int64           // stop_id + "|" + route -> platform number (0 if none)
+	unmatched map[string]map[string]bool // stop_id -> route names
+}
+
+func newStopMatcher(r *csv.Reader, platforms []*Platform, patterns []*Pattern) *stopMatcher {
+	m := &stopMatcher{
+		stops:     processStops(r),
+		platforms: make(map[int64]*Platform),
+		served:    make(map[string]map[int64]bool),
+		matches:   make(map[string]int64),
+		unmatched: make(map[string]map[string]bool),
+	}
+
+	for _, plat := range platforms {
+		m.platforms[plat.Number] = plat
+	}
+
+	for _, pattern := range patterns {
+		if m.served[pattern.Route] == nil {
+			m.served[pattern.Route] = make(map[int64]bool)
+		}
+		for _, plat := range pattern.Platforms {
+			m.served[pattern.Route][plat.Number] = true
+		}
+	}
+
+	return m
+}
+
+func processStops(r *csv.Reader) map[string]*gtfsStop {
+	stops := make(map[string]*gtfsStop)
+
+	records, _ := r.ReadAll()
+	if len(records) == 0 {
+		return stops
+	}
+
+	columns := columnIndex(records[0])
+	if !hasColumns(columns, "stop_id", "stop_name", "stop_lat", "stop_lon") {
+		return stops
+	}
+
+	codeCol, hasCode := columns["stop_code"]
+	for _, record := range records[1:] {
+		s := &gtfsStop{
+			id:   record[columns["stop_id"]],
+			name: record[columns["stop_name"]],
+		}
+
+		if hasCode {
+			s.code = strings.TrimSpace(record[codeCol])
+		}
+
+		// Coordinates are optional for matching by stop_code
+		s.lat, _ = strconv.ParseFloat(record[columns["stop_lat"]], 64)
+		s.lng, _ = strconv.ParseFloat(record[columns["stop_lon"]], 64)
+
+		stops[s.id] = s
+	}
+
+	return stops
+}
+
+// Platform number for stop_id when served by route (Connexionz name)
+func (m *stopMatcher) platform(stopID, routeName string) (int64, bool) {
+	cacheKey := stopID + "|" + routeName
+	if num, ok := m.matches[cacheKey]; ok {
+		return num, num != 0
+	}
+
+	num := m.match(stopID, routeName)
+	m.matches[cacheKey] = num
+
+	if num == 0 {
+		if m.unmatched[stopID] == nil {
+			m.unmatched[stopID] = make(map[string]bool)
+		}
+		m.unmatched[stopID][routeName] = true
+	}
+
+	return num, num != 0
+}
+
+func (m *stopMatcher) match(stopID, routeName string) int64 {
+	stop, ok := m.stops[stopID]
+	if !ok {
+		return 0
+	}
+
+	served := m.served[routeName]
+
+	// stop_code is the platform number
+	code, err := strconv.ParseInt(stop.code, 10, 64)
+	if _, known := m.platforms[code]; err != nil || !known {
+		code = 0
+	} else if served == nil || served[code] {
+		return code
+	}
+
+	if stop.lat == 0 && stop.lng == 0 {
+		return code
+	}
+
+	// Find closest platform with best name -- platforms on route first
+	stopLoc := geo.NewPoint(stop.lat, stop.lng)
+
+	var best *Platform
+	var bestServed bool
+	var bestScore, bestDist float64
+	for _, plat := range m.platforms {
+		dist := stopLoc.GreatCircleDistance(geo.NewPoint(plat.Lat, plat.Long)) * 1000.0 // In meters
+		if dist > stopMatchRadius {
+			continue
+		}
+
+		isServed := served[plat.Number]
+		score := nameSimilarity(stop.name, plat.Name)
+
+		better := best == nil ||
+			(isServed && !bestServed) ||
+			(isServed == bestServed && score > bestScore) ||
+			(isServed == bestServed && score == bestScore && dist < bestDist)
+
+		if better {
+			best, bestServed, bestScore, bestDist = plat, isServed, score, dist
+		}
+	}
+
+	// Require either route or name to agree -- closeness alone isn't enough
+	if best == nil || (!bestServed && bestScore == 0) {
+		return code // Platform from stop_code even though route doesn't list it
+	}
+
+	return best.Number
+}
+
+// Stops used by imported trips without a platform -- sorted by stop_id
+func (m *stopMatcher) report() []*UnmatchedStop {
+	report := []*UnmatchedStop{}
+	for stopID, routes := range m.unmatched {
+		u := &UnmatchedStop{ID: stopID}
+		if stop, ok := m.stops[stopID]; ok {
+			u.Code, u.Name, u.Lat, u.Lng = stop.code, stop.name, stop.lat, stop.lng
+		}
+
+		for name := range routes {
+			u.Routes = append(u.Routes, name)
+		}
+		sort.Strings(u.Routes)
+
+		report = append(report, u)
+	}
+
+	sort.Sort(byStopID(report))
+
+	return report
+}
+
+type byStopID []*UnmatchedStop
+
+func (a byStopID) Len() int           { return len(a) }
+func (a byStopID) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byStopID) Less(i, j int) bool { return a[i].ID < a[j].ID }
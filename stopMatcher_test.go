@@ -0,0 +1,82 @@
+package corvallisbus
+
+import (
+	"encoding/csv"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestStopMatcher(t *testing.T) {
+	platform := func(num int64, name string, p LatLng) *Platform {
+		return &Platform{Number: num, Name: name, Lat: p.Lat, Long: p.Lng}
+	}
+
+	// Downtown Transit Center has a platform per route
+	platforms := []*Platform{
+		platform(101, "NW 10th St & NW Buchanan Ave", testPoint(0, 0)),
+		platform(102, "Downtown Transit Center", testPoint(0, 1000)),
+		platform(103, "Downtown Transit Center", testPoint(10, 1000)),
+		platform(104, "Monroe & Kings", testPoint(1000, 0)),
+		platform(105, "Walnut & 9th", testPoint(2000, 0)),
+		platform(106, "Harrison & 29th", testPoint(2020, 0)),
+	}
+	patterns := []*Pattern{
+		{Route: "1", Platforms: []*Platform{platforms[0], platforms[1], platforms[3]}},
+		{Route: "2", Platforms: []*Platform{platforms[2], platforms[4]}},
+	}
+
+	stop := func(id, code, name string, p LatLng) string {
+		return fmt.Sprintf("%s,%s,%s,%f,%f\n", id, code, name, p.Lat, p.Lng)
+	}
+	stopsTxt := "stop_id,stop_code,stop_name,stop_lat,stop_lon\n" +
+		stop("S1", "101", "10th & Buchanan", testPoint(0, 0)) +
+		stop("DTC", "102", "Downtown Transit Center [Shelter]", testPoint(5, 1000)) +
+		stop("S4", "", "Monroe & Kings", testPoint(1005, 0)) +
+		stop("S5", "abc", "Walnut & 9th", testPoint(2010, 0)) +
+		stop("S6", "", "Unrelated", testPoint(2020, 5)) +
+		stop("S7", "999", "Far Away", testPoint(5000, 5000)) +
+		"S8,104,Monroe & Kings,,\n"
+
+	m := newStopMatcher(csv.NewReader(strings.NewReader(stopsTxt)), platforms, patterns)
+
+	tests := []struct {
+		name   string
+		stopID string
+		route  string
+		want   int64
+	}{
+		{"stop_code", "S1", "1", 101},
+		{"stop_code of route", "DTC", "1", 102},
+		{"platform of route at shared stop", "DTC", "2", 103},
+		{"no stop_code", "S4", "1", 104},
+		{"invalid stop_code", "S5", "2", 105},
+		{"name without route", "S5", "1", 105},
+		{"route without name", "S6", "2", 105},
+		{"close only", "S6", "1", 0},
+		{"unknown stop_code & far", "S7", "1", 0},
+		{"stop_code without coordinates", "S8", "2", 104},
+		{"unknown stop_id", "X", "1", 0},
+	}
+
+	for _, test := range tests {
+		num, ok := m.platform(test.stopID, test.route)
+		if num != test.want || ok != (test.want != 0) {
+			t.Errorf("%s: %s on route %s got %d, want %d", test.name, test.stopID, test.route, num, test.want)
+		}
+	}
+
+	// Cached
+	if num, _ := m.platform("DTC", "2"); num != 103 {
+		t.Errorf("cached: got %d, want 103", num)
+	}
+
+	report := m.report()
+	got := []string{}
+	for _, u := range report {
+		got = append(got, u.ID+":"+strings.Join(u.Routes, ","))
+	}
+	if want := "S6:1 S7:1 X:1"; strings.Join(got, " ") != want {
+		t.Errorf("report: got %v, want %s", got, want)
+	}
+}
@@ -0,0 +1,215 @@
+package corvallisbus
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+/stops/{id}/schedule (endpoint for the whole timetable of a stop)
+
+Default: timetable of today
+Paramaters:
+
+	date: date of service in RFC822Z format; Default: "currentDate"
+
+Response:
+
+	stop: stop object
+	routes: array of routes (by name) stopping at the stop
+	  Directions: array of directions (by name) -- trip headsign or pattern direction
+	    Arrivals: array of arrivals in order of time (ISO-8601)
+
+Includes trips after midnight that belong to the service day and applies
+calendar exceptions (holidays, breaks).
+*/
+func StopSchedule(c Context, w http.ResponseWriter, r *http.Request) {
+	// Make sure this is a GET request
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+
+	// /stops/{id}/schedule
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(parts) != 3 || parts[2] != "schedule" {
+		http.NotFound(w, r)
+		return
+	}
+
+	stopNum, idErr := strconv.ParseInt(parts[1], 10, 64)
+	if idErr != nil {
+		http.Error(w, "Paramater Error[id]: "+idErr.Error(), 400)
+		return
+	}
+
+	serviceDate, err := parseServiceDate(r)
+	if err != nil {
+		http.Error(w, "Paramater Error[date]: "+err.Error(), 400)
+		return
+	}
+
+	store := c.Store()
+	stops, err := store.Stops([]int64{stopNum})
+	if err != nil {
+		http.Error(w, "Get Stops Error: "+err.Error(), 500)
+		return
+	} else if stops[0] == nil {
+		http.Error(w, "Unknown stop: "+parts[1], 404)
+		return
+	}
+	stop := stops[0]
+	stop.ID = stopNum
+
+	arrivals, err := serviceDayArrivals(c, stopNum, serviceDate)
+	if err != nil {
+		http.Error(w, "Get Arrivals Error: "+err.Error(), 500)
+		return
+	}
+
+	routes, err := cachedRoutes(c, store)
+	if err != nil {
+		http.Error(w, "Get Routes Error: "+err.Error(), 500)
+		return
+	}
+
+	routeMap := make(map[string]*Route)
+	for _, route := range routes {
+		routeMap[route.Name] = route
+	}
+
+	output, err := prepareScheduleOutput(store, stopNum, arrivals, routeMap, serviceDayStart(serviceDate))
+	if err != nil {
+		http.Error(w, "Get Patterns Error: "+err.Error(), 500)
+		return
+	}
+
+	result := map[string]interface{}{
+		"stop":   stop,
+		"routes": output,
+	}
+
+	data, errJSON := json.Marshal(result)
+	if errJSON != nil {
+		http.Error(w, errJSON.Error(), 500)
+		return
+	}
+
+	// Output JSON
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprint(w, string(data))
+}
+
+// Midnight of date paramater (RFC822Z) in US/Pacific -- today if missing
+func parseServiceDate(r *http.Request) (time.Time, error) {
+	loc, _ := time.LoadLocation("America/Los_Angeles")
+	date := time.Now().In(loc)
+	if paramDate := r.FormValue("date"); len(paramDate) != 0 {
+		inputTime, err := time.Parse(time.RFC822Z, paramDate)
+		if err != nil {
+			return time.Time{}, err
+		}
+		date = inputTime.In(loc)
+	}
+
+	return time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, loc), nil
+}
+
+type scheduleRoute struct {
+	Route      string
+	RouteColor string `json:",omitempty"` // Hexadecimal
+	Directions []*scheduleDirection
+}
+
+type scheduleDirection struct {
+	Direction string
+	Arrivals  []*scheduleArrival
+}
+
+type scheduleArrival struct {
+	Scheduled   time.Time
+	TripID      string `json:",omitempty"` // See /trips
+	IsScheduled bool   // False for estimated times
+}
+
+// Arrivals grouped by route then direction -- times from start of the service day
+func prepareScheduleOutput(store Store, stopNum int64, arrivals []*Arrival, routeMap map[string]*Route, start time.Time) ([]*scheduleRoute, error) {
+	sort.Sort(ByScheduled(arrivals))
+
+	byRoute := make(map[string]*scheduleRoute)
+	byDirection := make(map[string]*scheduleDirection) // route + "|" + direction
+	names := []string{}
+	for _, arr := range arrivals {
+		route, ok := byRoute[arr.Route]
+		if !ok {
+			route = &scheduleRoute{Route: arr.Route, Directions: []*scheduleDirection{}}
+			if r, ok := routeMap[arr.Route]; ok {
+				route.RouteColor = r.Color
+			}
+			byRoute[arr.Route] = route
+			names = append(names, arr.Route)
+		}
+
+		// Headsign is shown on the bus -- direction of the pattern otherwise
+		direction := arr.Headsign
+		if direction == "" {
+			var err error
+			direction, err = stopDirection(store, arr.Route, stopNum)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		key := arr.Route + "|" + direction
+		dir, ok := byDirection[key]
+		if !ok {
+			dir = &scheduleDirection{Direction: direction, Arrivals: []*scheduleArrival{}}
+			byDirection[key] = dir
+			route.Directions = append(route.Directions, dir)
+		}
+
+		dir.Arrivals = append(dir.Arrivals, &scheduleArrival{
+			Scheduled:   start.Add(arr.Scheduled),
+			TripID:      arr.TripID,
+			IsScheduled: arr.IsScheduled,
+		})
+	}
+
+	sort.Strings(names)
+	output := make([]*scheduleRoute, len(names))
+	for i, name := range names {
+		output[i] = byRoute[name]
+		sort.Sort(byDirectionName(output[i].Directions))
+	}
+
+	return output, nil
+}
+
+// Direction of the first pattern of route passing stop -- "" if none
+func stopDirection(store Store, route string, stopNum int64) (string, error) {
+	patterns, err := cachedRoutePatterns(store, route)
+	if err != nil {
+		return "", err
+	}
+
+	for _, pattern := range patterns {
+		for _, id := range pattern.Stops {
+			if id == stopNum {
+				return pattern.Direction, nil
+			}
+		}
+	}
+
+	return "", nil
+}
+
+type byDirectionName []*scheduleDirection
+
+func (a byDirectionName) Len() int           { return len(a) }
+func (a byDirectionName) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byDirectionName) Less(i, j int) bool { return a[i].Direction < a[j].Direction }
@@ -0,0 +1,247 @@
+package corvallisbus
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/kellydunn/golang-geo"
+)
+
+// Stops matching less of the query than this are not returned (0-1)
+const minSearchScore = 0.5
+
+// Largest boost of a stop at the searched location -- less than a misspelled word
+const searchLocationBias = 0.1
+
+/*
+/stops/search (endpoint to find stops by name -- "10th & Buchanan")
+
+Default: nothing returned
+Paramaters:
+
+	q: words of the stop name or road (required); Default: ""
+	lat: latitude to prefer close stops (optional); Default: ""
+	lng: longitude to prefer close stops (optional); Default: ""
+	limit: limit the amount of stops returned; Default: 10
+
+Response:
+
+	stops: array of stop objects sorted by best match
+	  Distance is included with lat & lng.
+*/
+func SearchStops(c Context, w http.ResponseWriter, r *http.Request) {
+	// Make sure this is a GET request
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+
+	query := r.FormValue("q")
+	if strings.TrimSpace(query) == "" {
+		http.Error(w, "Missing required paramater: q", 400)
+		return
+	}
+
+	limit := 10
+	if r.FormValue("limit") != "" {
+		val, limErr := strconv.Atoi(r.FormValue("limit"))
+		if limErr != nil || val < 1 {
+			http.Error(w, "Paramater Error[limit]: must be a positive number", 400)
+			return
+		}
+		limit = val
+	}
+
+	// Location bias is optional
+	var location *geo.Point
+	if r.FormValue("lat") != "" && r.FormValue("lng") != "" {
+		lat, latErr := strconv.ParseFloat(r.FormValue("lat"), 64)
+		lng, lngErr := strconv.ParseFloat(r.FormValue("lng"), 64)
+		if latErr != nil || lngErr != nil {
+			http.Error(w, "Error in parsing Latitude and Longitude", 400)
+			return
+		}
+		location = geo.NewPoint(lat, lng)
+	}
+
+	index, err := cachedStopIndex(c)
+	if err != nil {
+		http.Error(w, "Get Stops Error: "+err.Error(), 500)
+		return
+	}
+
+	stops := searchStops(index, query, location)
+	if len(stops) > limit {
+		stops = stops[:limit]
+	}
+
+	result := map[string]interface{}{
+		"stops": stops,
+	}
+
+	data, errJSON := json.Marshal(result)
+	if errJSON != nil {
+		http.Error(w, errJSON.Error(), 500)
+		return
+	}
+
+	// Output JSON
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprint(w, string(data))
+}
+
+type searchResult struct {
+	stop  *Stop
+	score float64
+}
+
+type byScore []*searchResult
+
+func (a byScore) Len() int      { return len(a) }
+func (a byScore) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a byScore) Less(i, j int) bool {
+	if a[i].score != a[j].score {
+		return a[i].score > a[j].score
+	}
+	return a[i].stop.ID < a[j].stop.ID
+}
+
+// Stops matching query best first -- closer stops first with location
+func searchStops(index *stopIndex, query string, location *geo.Point) []*Stop {
+	queryTokens := searchTokens(query)
+	if len(queryTokens) == 0 {
+		return []*Stop{}
+	}
+
+	results := []*searchResult{}
+	for _, stop := range index.stops {
+		score := searchScore(queryTokens, searchTokens(stop.Name+" "+stop.Road))
+		if score < minSearchScore {
+			continue
+		}
+
+		if location != nil {
+			dist := location.GreatCircleDistance(geo.NewPoint(stop.Lat, stop.Long)) * 1000.0 // In meters
+			stop = withDistance(stop, dist)
+			score += searchLocationBias / (1 + dist/500)
+		}
+
+		results = append(results, &searchResult{stop, score})
+	}
+
+	sort.Sort(byScore(results))
+
+	stops := make([]*Stop, len(results))
+	for i, result := range results {
+		stops[i] = result.stop
+	}
+
+	return stops
+}
+
+// Distinct significant words of name with ordinals as numbers ("10th" -> "10")
+func searchTokens(name string) []string {
+	seen := make(map[string]bool)
+	tokens := []string{}
+	for _, token := range nameTokens(name) {
+		if unicode.IsDigit(rune(token[0])) {
+			token = strings.TrimRightFunc(token, unicode.IsLetter)
+		}
+
+		if !seen[token] {
+			seen[token] = true
+			tokens = append(tokens, token)
+		}
+	}
+	return tokens
+}
+
+// Average of how well each query word matches a word of the stop (0-1)
+//
+// Words of the stop not in the query lower the score slightly so stops
+// named exactly like the query come first ("Monroe & 14th" for "monroe 14th").
+func searchScore(query, stop []string) float64 {
+	if len(stop) == 0 {
+		return 0
+	}
+
+	total := 0.0
+	used := 0
+	for _, q := range query {
+		best := 0.0
+		for _, s := range stop {
+			if m := tokenMatch(q, s); m > best {
+				best = m
+			}
+		}
+		if best > 0 {
+			used++
+		}
+		total += best
+	}
+
+	extra := len(stop) - used
+	if extra < 0 {
+		extra = 0
+	}
+
+	return total/float64(len(query)) - 0.01*float64(extra)
+}
+
+// How well query word q matches stop word s (0-1)
+func tokenMatch(q, s string) float64 {
+	if q == s {
+		return 1
+	}
+
+	// Numbers must be exact -- 10th isn't close to 11th
+	if unicode.IsDigit(rune(q[0])) || unicode.IsDigit(rune(s[0])) {
+		return 0
+	}
+
+	// Still typing
+	if len(q) >= 2 && strings.HasPrefix(s, q) {
+		return 0.9
+	}
+
+	// Typos -- one per 4 letters (up to 2)
+	allowed := len(q) / 4
+	if allowed > 2 {
+		allowed = 2
+	}
+	if dist := editDistance(q, s); dist <= allowed {
+		return 1 - 0.2*float64(dist)
+	}
+
+	return 0
+}
+
+// Levenshtein distance
+func editDistance(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = minInt(minInt(prev[j]+1, cur[j-1]+1), prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+
+	return prev[len(rb)]
+}
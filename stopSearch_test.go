@@ -0,0 +1,69 @@
+package corvallisbus
+
+import (
+	"testing"
+
+	"github.com/kellydunn/golang-geo"
+)
+
+func TestSearchStops(t *testing.T) {
+	index := newStopIndex("", []*Stop{
+		{ID: 1, Name: "NW 10th St & NW Buchanan Ave", Lat: 44.5750, Long: -123.2650},
+		{ID: 2, Name: "NW 11th St & NW Buchanan Ave", Lat: 44.5750, Long: -123.2670},
+		{ID: 3, Name: "Monroe & 14th"},
+		{ID: 4, Name: "SW Monroe Ave & SW 14th St", Road: "Park"},
+		{ID: 5, Name: "Kings & Buchanan", Lat: 44.5750, Long: -123.2750},
+		{ID: 6, Name: "Walnut & Kings", Lat: 44.5900, Long: -123.2750},
+	})
+
+	tests := []struct {
+		name     string
+		query    string
+		location *geo.Point
+		want     []int64
+	}{
+		{"exact", "10th & Buchanan", nil, []int64{1}},
+		{"exact name first", "monroe 14th", nil, []int64{3, 4}},
+		{"ordinal", "11th", nil, []int64{2}},
+		{"numbers are exact", "12th", nil, []int64{}},
+		{"prefix", "buch", nil, []int64{1, 2, 5}},
+		{"prefix & exact", "buch kings", nil, []int64{5}},
+		{"typo", "buchanon", nil, []int64{1, 2, 5}},
+		{"too many typos", "bxxhanon", nil, []int64{}},
+		{"short word typo", "kigs", nil, []int64{5, 6}},
+		{"typo in 3 letters", "kgs", nil, []int64{}},
+		{"road", "monroe park", nil, []int64{4}},
+		{"ties by id", "kings", nil, []int64{5, 6}},
+		{"closer first", "kings", geo.NewPoint(44.5900, -123.2750), []int64{6, 5}},
+		{"empty", "", nil, []int64{}},
+		{"ignored words", "NW & St", nil, []int64{}},
+		{"single letter", "b", nil, []int64{}},
+	}
+
+	for _, test := range tests {
+		checkStopIDs(t, test.name, searchStops(index, test.query, test.location), test.want...)
+	}
+}
+
+func TestTokenMatch(t *testing.T) {
+	tests := []struct {
+		q, s string
+		want float64
+	}{
+		{"buchanan", "buchanan", 1},
+		{"buch", "buchanan", 0.9},
+		{"buchanon", "buchanan", 0.8},
+		{"bucanon", "buchanan", 0}, // 2 typos need 8 letters
+		{"kigs", "kings", 0.8},
+		{"kgs", "kings", 0},
+		{"10", "10", 1},
+		{"10", "100", 0},
+		{"1", "10", 0},
+	}
+
+	for _, test := range tests {
+		if got := tokenMatch(test.q, test.s); got < test.want-1e-9 || got > test.want+1e-9 {
+			t.Errorf("tokenMatch(%q, %q) = %v, want %v", test.q, test.s, got, test.want)
+		}
+	}
+}
@@ -1,27 +1,14 @@
 package corvallisbus
 
 import (
-	"appengine"
-	"appengine/datastore"
-	"appengine/memcache"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
-	"sort"
 	"strconv"
 	"strings"
-	"sync"
-
-	"github.com/kellydunn/golang-geo"
 )
 
-//
-// Global
-//
-
-var stopLocations map[int64]*geo.Point // StopID to location point
-
 /*
   /stops (endpoint to access stop information)
 
@@ -31,15 +18,19 @@ var stopLocations map[int64]*geo.Point // StopID to location point
     lat: latitude for search; Default: ""
     lng: longitude for search; Default: ""
     radius: radius in meters to make search; Default: 500
+    k: return the k closest stops instead of a radius search (optional); Default: ""
+    bbox: stops inside of "minLat,minLng,maxLat,maxLng" (optional); Default: ""
+    routes: comma delimited list of route names -- only with bbox (optional); Default: ""
     limit: limit the amount of stops returned; Default: none
   Response:
     stops: array of stops objects
       -- Sort order different based on paramaters
         -- location: sorted by distance
         -- ids: sorted by ids
+        -- bbox: sorted by ids
 
 */
-func Stops(c appengine.Context, w http.ResponseWriter, r *http.Request) {
+func Stops(c Context, w http.ResponseWriter, r *http.Request) {
 	// Determing if need to search based on location or use stopNumbers
 	var stops []*Stop
 	var err error
@@ -48,33 +39,47 @@ func Stops(c appengine.Context, w http.ResponseWriter, r *http.Request) {
 		// Split on commas
 		sepIDs := strings.Split(r.FormValue("ids"), ",")
 
-		// Make keys
-		keys := make([]*datastore.Key, len(sepIDs))
-		actualCount := 0
+		// Parse ids
+		ids := []int64{}
 		for _, id := range sepIDs {
 			idVal, idErr := strconv.ParseInt(id, 10, 64)
 			if idErr == nil {
-				keys[actualCount] = datastore.NewKey(c, "Stop", "", idVal, nil)
-				actualCount++
+				ids = append(ids, idVal)
 			}
 		}
 
-		keys = keys[:actualCount]
-
-		if len(keys) > 0 {
+		if len(ids) > 0 {
 			// Do a search by IDs
-			stops = make([]*Stop, len(keys))
-			for i, _ := range stops {
-				stops[i] = new(Stop)
-			}
-			datastore.GetMulti(c, keys, stops)
+			stops, err = c.Store().Stops(ids)
 
-			// Populate IDs
+			// Populate IDs -- unknown stops are left empty
 			for i, stop := range stops {
-				stop.ID = keys[i].IntID()
+				if stop == nil {
+					stops[i] = &Stop{}
+				}
+				stops[i].ID = ids[i]
 			}
 		}
 
+	} else if r.FormValue("bbox") != "" {
+		// Do a bounding box search (map viewport)
+		box, boxErr := parseBoundingBox(r.FormValue("bbox"))
+		if boxErr != nil {
+			http.Error(w, "Paramater Error[bbox]: "+boxErr.Error(), 400)
+			return
+		}
+
+		var routes []string
+		if r.FormValue("routes") != "" {
+			routes = strings.Split(r.FormValue("routes"), ",")
+		}
+
+		var index *stopIndex
+		index, err = cachedStopIndex(c)
+		if err == nil {
+			stops = index.inBox(box[0], box[1], box[2], box[3], routes)
+		}
+
 	} else if r.FormValue("lat") != "" && r.FormValue("lng") != "" {
 		// Do a radius search
 		lat, latErr := strconv.ParseFloat(r.FormValue("lat"), 64)
@@ -90,7 +95,18 @@ func Stops(c appengine.Context, w http.ResponseWriter, r *http.Request) {
 				}
 			}
 
-			stops, err = stopsInRadius(c, lat, lng, radius)
+			if r.FormValue("k") != "" {
+				// Do a k-nearest search
+				k, kErr := strconv.Atoi(r.FormValue("k"))
+				if kErr != nil || k < 1 {
+					http.Error(w, "Paramater Error[k]: must be a positive number", 400)
+					return
+				}
+
+				stops, err = nearestStops(c, lat, lng, k)
+			} else {
+				stops, err = stopsInRadius(c, lat, lng, radius)
+			}
 
 		} else {
 			err = errors.New("Error in parsing Latitude and Longitude")
@@ -98,13 +114,7 @@ func Stops(c appengine.Context, w http.ResponseWriter, r *http.Request) {
 
 	} else {
 		// Return all stops -- will take a while
-		var keys []*datastore.Key
-		keys, err = datastore.NewQuery("Stop").Order("__key__").GetAll(c, &stops)
-
-		// Populate IDs
-		for i, stop := range stops {
-			stop.ID = keys[i].IntID()
-		}
+		stops, err = c.Store().AllStops()
 	}
 
 	if err != nil {
@@ -145,109 +155,46 @@ func Stops(c appengine.Context, w http.ResponseWriter, r *http.Request) {
 	fmt.Fprint(w, string(data))
 }
 
-func stopsInRadius(c appengine.Context, lat, lng float64, radiusMeters int) ([]*Stop, error) {
-
-	// Check if we need to populate memory
-	if stopLocations == nil {
-		// Get all stops -- only coordinates
-		stops := []Stop{}
-		keys, err := datastore.NewQuery("Stop").GetAll(c, &stops)
-		if err != nil {
-			c.Debugf("Stop QUERY ERROR", stops)
-			return nil, err
-		}
-
-		stopLocations = make(map[int64]*geo.Point)
-
-		for i, stop := range stops {
-			stopLocations[keys[i].IntID()] = geo.NewPoint(stop.Lat, stop.Long)
-		}
-	}
-
-	// Determine geohash for given position
-	currentLoc := geo.NewPoint(lat, lng)
-
-	// Create array of stopIDS
-	desiredStops := make([]*datastore.Key, len(stopLocations))
-	distances := make([]float64, len(stopLocations))
-
-	// Filter by distance
-	matchingCount := 0
-	for key, loc := range stopLocations {
-		dist := currentLoc.GreatCircleDistance(loc) * 1000.0 // In meters
-		if int(dist) <= radiusMeters {
-			desiredStops[matchingCount] = datastore.NewKey(c, "Stop", "", key, nil)
-			distances[matchingCount] = dist
-			matchingCount++
-		}
+// Stops within radius (meters) sorted by distance -- see stopIndex
+func stopsInRadius(c Context, lat, lng float64, radiusMeters int) ([]*Stop, error) {
+	index, err := cachedStopIndex(c)
+	if err != nil {
+		return nil, err
 	}
 
-	// Sort by distance closest to farthest
-	var stops []*Stop
-	if matchingCount > 0 {
-		var err error
-		stops, err = getStopsWithKeys(c, desiredStops[:matchingCount])
-		if err != nil {
-			return nil, err
-		}
-	}
+	return index.inRadius(lat, lng, radiusMeters), nil
+}
 
-	// Populate with key and distance
-	for i, stop := range stops {
-		stop.ID = desiredStops[i].IntID()
-		stop.Distance = distances[i]
+// k closest stops sorted by distance -- see stopIndex
+func nearestStops(c Context, lat, lng float64, k int) ([]*Stop, error) {
+	index, err := cachedStopIndex(c)
+	if err != nil {
+		return nil, err
 	}
 
-	// Sort by distance
-	sort.Sort(ByDistance{stops})
-
-	// Return stops
-	return stops, nil
+	return index.nearest(lat, lng, k), nil
 }
 
-func getStopsWithKeys(c appengine.Context, keys []*datastore.Key) ([]*Stop, error) {
-	// Get these stops
-	stops := make([]*Stop, len(keys))
-
-	var wg sync.WaitGroup
-
-	for i, key := range keys {
-		wg.Add(1)
+// minLat,minLng,maxLat,maxLng
+func parseBoundingBox(value string) ([4]float64, error) {
+	var box [4]float64
 
-		go func(idx int, k *datastore.Key) {
-			defer wg.Done()
-
-			// Determine Cache Name
-			cacheName := "Stop:" + strconv.FormatInt(k.IntID(), 10)
-
-			// Check memcache
-			stop := new(Stop)
-			if _, memError := memcache.Gob.Get(c, cacheName, stop); memError == memcache.ErrCacheMiss {
-				err := datastore.Get(c, k, stop)
-				if err != nil {
-					c.Debugf("Get Stops Error: ", k)
-				}
-
-				// Add to memcache
-				item := &memcache.Item{
-					Key:    cacheName,
-					Object: stop,
-				}
-
-				wg.Add(1)
-				go func() {
-					defer wg.Done()
-					memcache.Gob.Set(c, item) // We do enough work below that this will finish
-				}()
-			}
-
-			// Add to list
-			stops[idx] = stop
+	parts := strings.Split(value, ",")
+	if len(parts) != 4 {
+		return box, errors.New("expected minLat,minLng,maxLat,maxLng")
+	}
 
-		}(i, key)
+	for i, part := range parts {
+		val, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil {
+			return box, err
+		}
+		box[i] = val
 	}
 
-	wg.Wait()
+	if box[0] > box[2] || box[1] > box[3] {
+		return box, errors.New("minimum larger than maximum")
+	}
 
-	return stops, nil
+	return box, nil
 }
@@ -0,0 +1,59 @@
+package corvallisbus
+
+import (
+	"time"
+)
+
+// Store holds all imported transit information.
+//
+// Information is read from and written to a single dataset -- the active
+// dataset unless the store came from NewDataset.
+//
+// Implementations:
+//   - datastoreStore -- App Engine datastore (with memcache)
+//   - BoltStore -- embedded on-disk database for running outside App Engine
+type Store interface {
+	// Version of dataset used by store ("" when nothing has been imported)
+	Version() string
+
+	// Routes sorted by name
+	Routes() ([]*Route, error)
+	PutRoute(route *Route) error
+
+	// All patterns of route (in Connexionz order)
+	RoutePatterns(route string) ([]*RoutePattern, error)
+	PutRoutePatterns(route string, patterns []*RoutePattern) error
+
+	// Stops in the same order as ids -- unknown stops are nil
+	Stops(ids []int64) ([]*Stop, error)
+	AllStops() ([]*Stop, error)
+	PutStop(stop *Stop) error
+
+	// Arrivals at a stop sorted by scheduled time
+	Arrivals(stop int64, day time.Weekday) ([]*Arrival, error)
+	ServiceArrivals(stop int64, serviceID string) ([]*Arrival, error)
+	PutArrivals(arrivals []*Arrival) error
+
+	// Trips in the same order as ids -- unknown trips are nil
+	Trips(ids []string) ([]*Trip, error)
+	AllTrips() ([]*Trip, error)
+	PutTrips(trips []*Trip) error
+
+	// Exceptions for a date (midnight US/Pacific)
+	CalendarExceptions(date time.Time) ([]*CalendarException, error)
+	PutCalendarException(exception *CalendarException) error
+
+	// Admin provided route name mapping (GTFS route_id -> Connexionz name) -- shared by all datasets
+	RouteNameOverrides() ([]*RouteNameOverride, error)
+	PutRouteNameOverride(override *RouteNameOverride) error
+	DeleteRouteNameOverride(gtfs string) error
+
+	// Datasets sorted newest first
+	Datasets() ([]*Dataset, error)
+	// Store writing to a new dataset -- not used by queries until activated
+	NewDataset() (Store, error)
+	// Switches queries to dataset version
+	Activate(version string) error
+	// Removes dataset version (except the active dataset)
+	DeleteDataset(version string) error
+}
@@ -0,0 +1,232 @@
+package corvallisbus
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Feed is rebuilt when older than this -- same as the default poll interval
+const tripUpdatesMaxAge = 30 * time.Second
+
+// ETAs of every stop are only known from the poller -- fetching them for a request is too slow
+var errNoETAPoller = errors.New("Trip updates need the ETA poller (cmd/corvallis-bus with -eta-poll)")
+
+var globalTripUpdates *feedMessage
+var globalTripUpdatesVersion string  // Dataset of globalTripUpdates
+var globalTripUpdatesLock sync.Mutex // Guards globalTripUpdates -- held while building so requests share one build
+
+/*
+/gtfs-rt/trip-updates (endpoint for realtime arrivals in GTFS-Realtime)
+
+Default: returns FeedMessage (protocol buffer) of all trips with realtime arrivals
+Paramaters:
+
+	format: "json" to return the same FeedMessage as JSON (debugging); Default: ""
+
+Response:
+
+	FeedMessage with a TripUpdate entity for each trip (entity id is trip_id)
+	  Stop ids and trip ids are from Google Transit. Updated every 30 seconds.
+
+Built from the ETA poller -- 503 when it isn't running (App Engine).
+*/
+func TripUpdates(c Context, w http.ResponseWriter, r *http.Request) {
+	// Make sure this is a GET request
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+
+	feed, err := cachedTripUpdates(c)
+	if err == errNoETAPoller {
+		http.Error(w, "Trip Updates Error: "+err.Error(), 503)
+		return
+	} else if err != nil {
+		http.Error(w, "Trip Updates Error: "+err.Error(), 500)
+		return
+	}
+
+	if r.FormValue("format") == "json" {
+		data, errJSON := json.Marshal(feed)
+		if errJSON != nil {
+			http.Error(w, errJSON.Error(), 500)
+			return
+		}
+
+		// Output JSON
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, string(data))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	w.Write(feed.marshal())
+}
+
+func cachedTripUpdates(c Context) (*feedMessage, error) {
+	poller := globalETAPoller
+	if poller == nil {
+		return nil, errNoETAPoller
+	}
+
+	version := c.Store().Version()
+
+	globalTripUpdatesLock.Lock()
+	defer globalTripUpdatesLock.Unlock()
+
+	feed := globalTripUpdates
+	if feed != nil && globalTripUpdatesVersion == version &&
+		time.Since(time.Unix(int64(feed.Header.Timestamp), 0)) < tripUpdatesMaxAge {
+		return feed, nil
+	}
+
+	loc, _ := time.LoadLocation("America/Los_Angeles")
+	feed, err := buildTripUpdates(c, poller, time.Now().In(loc))
+	if err != nil {
+		return nil, err
+	}
+
+	globalTripUpdates, globalTripUpdatesVersion = feed, version
+
+	return feed, nil
+}
+
+// ETA of a trip at a stop
+type tripStopETA struct {
+	stop    int64
+	arrival *Arrival
+	eta     *ETA
+}
+
+// Polled ETAs matched to scheduled trips -- c.Realtime() must be poller (see newRealtimeProvider)
+//
+// Only platforms with ETAs in the latest poll are looked up.
+func buildTripUpdates(c Context, poller *etaPoller, now time.Time) (*feedMessage, error) {
+	snapshot := poller.latest()
+	if snapshot == nil {
+		return nil, errors.New("No ETAs polled yet")
+	}
+
+	stops := []string{}
+	for platform, etas := range snapshot.platforms {
+		if len(etas.arrivals) > 0 {
+			stops = append(stops, strconv.FormatInt(platform, 10))
+		}
+	}
+
+	// Only ETAs matched to a scheduled arrival have a trip
+	byTrip := make(map[string][]*tripStopETA)
+	tripIDs := []string{}
+	for s, arrivals := range findArrivalsForStops(c, stops, true, &now) {
+		stopNum, _ := strconv.ParseInt(s, 10, 64)
+		for _, m := range arrivals.matched {
+			if m.arrival.TripID == "" {
+				continue
+			}
+
+			if _, ok := byTrip[m.arrival.TripID]; !ok {
+				tripIDs = append(tripIDs, m.arrival.TripID)
+			}
+			byTrip[m.arrival.TripID] = append(byTrip[m.arrival.TripID], &tripStopETA{stopNum, m.arrival, m.eta})
+		}
+	}
+	sort.Strings(tripIDs)
+
+	trips, err := c.Store().Trips(tripIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	loc, _ := time.LoadLocation("America/Los_Angeles")
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, loc)
+	yesterday := time.Date(now.Year(), now.Month(), now.Day()-1, 0, 0, 0, 0, loc)
+
+	start := serviceDayStart(now)
+	dayLength := start.Sub(serviceDayStart(yesterday))
+
+	feed := &feedMessage{
+		Header: &feedHeader{
+			GtfsRealtimeVersion: gtfsRealtimeVersion,
+			Timestamp:           uint64(now.Unix()),
+		},
+		Entity: []*feedEntity{},
+	}
+
+	for i, trip := range trips {
+		if trip == nil {
+			continue
+		}
+
+		update := &tripUpdate{
+			Trip:           &tripDescriptor{TripID: trip.ID, StartDate: today.Format("20060102")},
+			StopTimeUpdate: []*stopTimeUpdate{},
+			Timestamp:      uint64(now.Unix()),
+		}
+
+		// Position in trip for ordering
+		positions := make(map[*stopTimeUpdate]int)
+		for _, e := range byTrip[tripIDs[i]] {
+			pos, previousDay := tripStopPosition(trip, e.stop, e.arrival.Scheduled, dayLength)
+			if pos == -1 {
+				continue
+			}
+			if previousDay {
+				update.Trip.StartDate = yesterday.Format("20060102")
+			}
+
+			delay := int32((e.eta.expected - e.arrival.Scheduled) / time.Second)
+			u := &stopTimeUpdate{
+				StopID: trip.StopTimes[pos].StopID,
+				Arrival: &stopTimeEvent{
+					Delay: &delay,
+					Time:  start.Add(e.eta.expected).Unix(),
+				},
+			}
+			positions[u] = pos
+			update.StopTimeUpdate = append(update.StopTimeUpdate, u)
+		}
+
+		if len(update.StopTimeUpdate) == 0 {
+			continue
+		}
+
+		sort.Sort(byTripPosition{update.StopTimeUpdate, positions})
+		feed.Entity = append(feed.Entity, &feedEntity{ID: trip.ID, TripUpdate: update})
+	}
+
+	return feed, nil
+}
+
+// Index in trip of arrival at stop -- arrivals of the previous service day are shifted by dayLength
+func tripStopPosition(trip *Trip, stop int64, scheduled, dayLength time.Duration) (int, bool) {
+	for i, st := range trip.StopTimes {
+		if st.Stop != stop {
+			continue
+		}
+
+		if st.Scheduled == scheduled {
+			return i, false
+		} else if st.Scheduled == scheduled+dayLength {
+			return i, true
+		}
+	}
+
+	return -1, false
+}
+
+type byTripPosition struct {
+	updates   []*stopTimeUpdate
+	positions map[*stopTimeUpdate]int
+}
+
+func (a byTripPosition) Len() int      { return len(a.updates) }
+func (a byTripPosition) Swap(i, j int) { a.updates[i], a.updates[j] = a.updates[j], a.updates[i] }
+func (a byTripPosition) Less(i, j int) bool {
+	return a.positions[a.updates[i]] < a.positions[a.updates[j]]
+}
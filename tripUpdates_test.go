@@ -0,0 +1,94 @@
+package corvallisbus
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTripUpdatesNeedPoller(t *testing.T) {
+	c := &testContext{t: t, store: &testStore{}}
+
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "/gtfs-rt/trip-updates", nil)
+	TripUpdates(c, w, r)
+	if w.Code != 503 {
+		t.Errorf("got status %d without poller, want 503", w.Code)
+	}
+}
+
+// Poller with ETAs (minutes from now) of route 1 at each platform
+func testPoller(minutes map[int64]int) *etaPoller {
+	snapshot := &etaSnapshot{polled: time.Now(), platforms: make(map[int64]*platformETAs)}
+	for platform, m := range minutes {
+		snapshot.platforms[platform] = newPlatformETAs([]*Prediction{{Route: "1", Minutes: m}}, time.Now())
+	}
+	return &etaPoller{staleness: time.Hour, snapshot: snapshot}
+}
+
+func TestBuildTripUpdates(t *testing.T) {
+	// Arrivals are the same at every stop -- only stop 2 has them in its trips
+	store := &testStore{
+		arrivals: map[time.Weekday][]*Arrival{
+			time.Friday: {
+				{Route: "1", TripID: "day", Scheduled: 8*time.Hour + 10*time.Minute, Friday: true},
+				{Route: "1", TripID: "night", Scheduled: 24*time.Hour + 10*time.Minute, Friday: true},
+			},
+		},
+		trips: map[string]*Trip{
+			"day": {ID: "day", Route: "1", StopTimes: []StopTime{
+				{StopID: "A", Stop: 1, Scheduled: 8 * time.Hour},
+				{StopID: "B", Stop: 2, Scheduled: 8*time.Hour + 10*time.Minute},
+			}},
+			"night": {ID: "night", Route: "1", StopTimes: []StopTime{
+				{StopID: "A", Stop: 1, Scheduled: 23*time.Hour + 55*time.Minute},
+				{StopID: "B", Stop: 2, Scheduled: 24*time.Hour + 10*time.Minute},
+			}},
+		},
+	}
+
+	tests := []struct {
+		name      string
+		now       time.Time
+		etas      map[int64]int
+		trip      string
+		startDate string
+	}{
+		// ETA at platform 1 matches the arrival at 08:10 -- not when trip is at stop 1
+		{"same day", pacificDate(2026, time.October, 16).Add(8 * time.Hour), map[int64]int{1: 10, 2: 12}, "day", "20261016"},
+		{"past midnight", pacificDate(2026, time.October, 17).Add(5 * time.Minute), map[int64]int{2: 7}, "night", "20261016"},
+	}
+
+	for _, test := range tests {
+		poller := testPoller(test.etas)
+		c := &testContext{t: t, store: store, realtime: poller}
+
+		feed, err := buildTripUpdates(c, poller, test.now)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(feed.Entity) != 1 {
+			t.Errorf("%s: got %d entities, want 1", test.name, len(feed.Entity))
+			continue
+		}
+
+		u := feed.Entity[0].TripUpdate
+		if feed.Entity[0].ID != test.trip || u.Trip.TripID != test.trip || u.Trip.StartDate != test.startDate {
+			t.Errorf("%s: got trip %s on %s, want %s on %s", test.name, u.Trip.TripID, u.Trip.StartDate, test.trip, test.startDate)
+		}
+
+		// 2 minutes late at B
+		if len(u.StopTimeUpdate) != 1 {
+			t.Errorf("%s: got %d stop time updates, want 1", test.name, len(u.StopTimeUpdate))
+			continue
+		}
+
+		su := u.StopTimeUpdate[0]
+		expected := test.now.Add(time.Duration(test.etas[2]) * time.Minute).Unix()
+		if su.StopID != "B" || su.Arrival == nil || su.Arrival.Delay == nil || *su.Arrival.Delay != 120 || su.Arrival.Time != expected {
+			t.Errorf("%s: got %+v, want B 120 seconds late at %d", test.name, su, expected)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package corvallisbus
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+/*
+/trips (endpoint to access trip information -- a single run of a bus)
+
+Default: nothing returned
+Paramaters:
+
+	id: comma delimited list of trip ids (required & limited to 20 ids); Default: ""
+	date: date of service in RFC822Z format; Default: "currentDate"
+
+Response:
+
+	trips: array of trip objects in the same order as id (null for unknown trips)
+	  StopTimes are in order travelled with times in ISO-8601 (RFC 3339).
+*/
+func Trips(c Context, w http.ResponseWriter, r *http.Request) {
+	// Make sure this is a GET request
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+
+	ids := strings.Split(r.FormValue("id"), ",")
+	if len(ids) == 0 || ids[0] == "" {
+		http.Error(w, "Missing required paramater: id", 400)
+		return
+	} else if len(ids) > 20 {
+		http.Error(w, "Maximum of 20 trips exceeded", 400)
+		return
+	}
+
+	// Use date input if avaliable
+	loc, _ := time.LoadLocation("America/Los_Angeles")
+	serviceDate := time.Now().In(loc)
+	if paramDate := r.FormValue("date"); len(paramDate) != 0 {
+		inputTime, timeErr := time.Parse(time.RFC822Z, paramDate)
+		if timeErr != nil {
+			http.Error(w, "Paramater Error[date]: "+timeErr.Error(), 400)
+			return
+		}
+		serviceDate = inputTime.In(loc)
+	}
+
+	trips, err := c.Store().Trips(ids)
+	if err != nil {
+		http.Error(w, "Get Trips Error: "+err.Error(), 500)
+		return
+	}
+
+	output := make([]*tripOutput, len(trips))
+	for i, trip := range trips {
+		if trip != nil {
+			output[i] = prepareTripOutput(trip, serviceDayStart(serviceDate))
+		}
+	}
+
+	result := map[string]interface{}{
+		"trips": output,
+	}
+
+	data, errJSON := json.Marshal(result)
+	if errJSON != nil {
+		http.Error(w, errJSON.Error(), 500)
+		return
+	}
+
+	// Output JSON
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprint(w, string(data))
+}
+
+type tripOutput struct {
+	ID        string
+	ServiceID string
+	Route     string
+	Headsign  string `json:",omitempty"`
+	StopTimes []*stopTimeOutput
+}
+
+type stopTimeOutput struct {
+	StopID      string
+	Stop        int64 `json:",omitempty"`
+	Scheduled   time.Time
+	IsScheduled bool
+}
+
+// Times are offsets from start of the service day (see serviceDayStart)
+func prepareTripOutput(trip *Trip, start time.Time) *tripOutput {
+	o := &tripOutput{
+		ID:        trip.ID,
+		ServiceID: trip.ServiceID,
+		Route:     trip.Route,
+		Headsign:  trip.Headsign,
+		StopTimes: make([]*stopTimeOutput, len(trip.StopTimes)),
+	}
+
+	for i, st := range trip.StopTimes {
+		o.StopTimes[i] = &stopTimeOutput{
+			StopID:      st.StopID,
+			Stop:        st.Stop,
+			Scheduled:   start.Add(st.Scheduled),
+			IsScheduled: st.IsScheduled,
+		}
+	}
+
+	return o
+}
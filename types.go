@@ -1,7 +1,6 @@
 package corvallisbus
 
 import (
-	"appengine/datastore"
 	"time"
 )
 
@@ -19,11 +18,12 @@ import (
     * Schedule (calendar.txt)
     * Scheduled Arrivals (stop_times.txt)
     * Route color (routes.txt)
+    * Route polylines (shapes.txt)
     * Service Exceptions (calendar_dates.txt)
 */
 
 type Route struct {
-	// Key is autogenerated (int64) -- No need to call directly by key
+	// Key equal to Name (string)
 	Name           string `json:",omitempty"` // Treated the same as route number for most routes
 	AdditionalName string `json:",omitempty"` // More user-friendly (ie BB_N -> Beaver Bus- North)
 
@@ -34,14 +34,27 @@ type Route struct {
 	Polyline string `datastore:",noindex" json:",omitempty"` // Needed due to length
 	Color    string `json:",omitempty"`                      // Route color stored as hexadecimal
 
-	Direction string           `json:",omitempty"`
-	Stops     []*datastore.Key `json:"-"`                        // organized by order travelled
-	Path      []*Stop          `datastore:"-" json:",omitempty"` // Calculated at runtime
+	// Longest pattern -- see Patterns for all
+	Direction string          `json:",omitempty"`
+	Stops     []int64         `json:"-"`                        // Stop IDs organized by order travelled
+	Path      []*Stop         `datastore:"-" json:",omitempty"` // Calculated at runtime
+	Patterns  []*RoutePattern `datastore:"-" json:",omitempty"` // Loaded at runtime (Store().RoutePatterns)
 
 	Start time.Time `json:"-"` // Begining of validity of arrivals
 	End   time.Time `json:"-"` // End of validity of arrivals
 }
 
+// Single variant of a route (direction, short-turn, ...) from Connexionz
+type RoutePattern struct {
+	// Key is index in route (int) -- parent is Route
+
+	Destination string
+	Direction   string  `json:",omitempty"`
+	Stops       []int64 // Stop IDs organized by order travelled
+
+	Polyline string `datastore:",noindex" json:",omitempty"` // From shapes.txt when available
+}
+
 type Stop struct {
 	// Key equal to platform number (int) -- same value posted at bus signs
 	ID int64 `datastore:"-"`
@@ -69,17 +82,25 @@ type ByDistance struct{ StopSlice }
 
 func (s ByDistance) Less(i, j int) bool { return s.StopSlice[i].Distance < s.StopSlice[j].Distance }
 
+type ByStopID struct{ StopSlice }
+
+func (s ByStopID) Less(i, j int) bool { return s.StopSlice[i].ID < s.StopSlice[j].ID }
+
 type Arrival struct {
 	// Key will be an autogenerated incomplete Key (int)
 	// Parent will be Stop associated with this time
 	// Run query to find
-	Route     *datastore.Key
-	routeName string `json:"-" datastore:"-"`
+	Stop  int64  `datastore:"-"` // Populated from parent key
+	Route string // Route name
 
-	Scheduled time.Duration // Stored as offset from midnight in US/Pacific
+	Scheduled time.Duration // Stored as offset from start of service day (noon minus 12h in US/Pacific)
 
 	IsScheduled bool // true for values with known schedule times -- others are estimates
 
+	ServiceID string `json:"-"`                               // GTFS service_id -- used to apply calendar exceptions
+	Headsign  string `datastore:",noindex" json:",omitempty"` // GTFS trip_headsign -- destination shown on bus
+	TripID    string `datastore:",noindex" json:",omitempty"` // GTFS trip_id -- see Trip
+
 	// What days of the week this arrival is valid on
 	Monday    bool `json:"-"`
 	Tuesday   bool `json:"-"`
@@ -95,10 +116,60 @@ type ETA struct {
 	expected time.Duration
 }
 
+// Implement sorting
+type ByScheduled []*Arrival
+
+func (a ByScheduled) Len() int           { return len(a) }
+func (a ByScheduled) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a ByScheduled) Less(i, j int) bool { return a[i].Scheduled < a[j].Scheduled }
+
 // https://developers.google.com/transit/gtfs/reference?csw=1#calendar_dates_fields
+// Single run of a bus from Google Transit (trips.txt & stop_times.txt)
+type Trip struct {
+	// Key equal to ID (string)
+	ID        string `datastore:"-"`
+	ServiceID string // GTFS service_id -- days from calendar.txt & calendar_dates.txt
+	Route     string // Connexionz route name
+	Headsign  string `datastore:",noindex" json:",omitempty"`
+
+	StopTimes []StopTime `datastore:",noindex"` // Ordered by stop_sequence
+
+	Days []bool `datastore:",noindex" json:"-"` // Days of the week (Monday first) from calendar.txt
+}
+
+// Time a trip reaches a stop
+type StopTime struct {
+	StopID      string        // GTFS stop_id
+	Stop        int64         `json:",omitempty"` // Platform number -- 0 if not known to Connexionz
+	Scheduled   time.Duration // Offset from start of service day (noon minus 12h in US/Pacific)
+	IsScheduled bool          // true for times from stop_times.txt -- others are estimates
+}
+
 type CalendarException struct {
-	// Key will be an autogenerated incomplete Key (string) -- string is faster
+	// Key is a string: ServiceID + "_" + date (YYYYMMDD) -- reimports overwrite
+
+	ServiceID string
+	Type      int8      // ServiceAdded or ServiceRemoved
+	Date      time.Time // Midnight in US/Pacific
+}
+
+// Values of CalendarException.Type (exception_type in calendar_dates.txt)
+const (
+	ServiceAdded   = 1
+	ServiceRemoved = 2
+)
+
+type RouteNameOverride struct {
+	// Key equal to GTFS (string) -- kept when information is re-imported
+
+	GTFS       string // route_id in routes.txt
+	Connexionz string // Route name in Connexionz
+}
+
+type Dataset struct {
+	// Key equal to Version (string)
 
-	Type int8
-	Date time.Time
+	Version string    // Import start time (UTC) -- sorts oldest to newest
+	Created time.Time // Import start time
+	Active  bool      `datastore:"-"` // Used by queries
 }